@@ -0,0 +1,135 @@
+package treelock
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// Grant describes a lock that was acquired and not yet released.
+type Grant struct {
+	// ID identifies the grant within the L instance that issued it.
+	ID uint64
+
+	// Path is the path of the locked node.
+	Path []string
+
+	// Mode is the name of the method used to acquire the lock, e.g.
+	// "ReadNode" or "WriteTree".
+	Mode string
+
+	// Owner is the label of the owner that acquired the lock, or empty
+	// if the lock was acquired directly through L.
+	Owner string
+}
+
+func (l *L) grantOf(o *operation) Grant {
+	g := Grant{
+		ID:   o.id,
+		Path: append([]string(nil), o.path...),
+		Mode: l.modes.name(o.typ),
+	}
+
+	if o.owner != nil {
+		g.Owner = o.owner.label
+	}
+
+	return g
+}
+
+// Grants returns the locks currently held on the node represented by
+// the path, or on any node in its subtree. Operations still waiting for
+// their lock are not included. When the path exceeds the limits of L,
+// it returns no grants.
+//
+func (l *L) Grants(path ...string) []Grant {
+	// no locks can be held on paths exceeding the limits
+	if l.CheckPath(path...) != nil || atomic.LoadUint32(&l.ready) == 0 {
+		return nil
+	}
+
+	path = l.canonicalPath(path)
+	l.tree.mx.Lock()
+	g := l.collectGrants(nil, l.tree.operations, path)
+	l.tree.mx.Unlock()
+	switch {
+	case len(path) == 0:
+		for i := range l.shards {
+			r := &l.shards[i].root
+			r.mx.Lock()
+			g = l.collectGrants(g, r.subtreeOperations, path)
+			r.mx.Unlock()
+		}
+	case !l.global(path):
+		if n := l.findLocked(path[:l.anchor(path)]); n != nil {
+			g = l.collectGrants(g, n.operations, path)
+			g = l.collectGrants(g, n.subtreeOperations, path)
+			n.mx.Unlock()
+		}
+	}
+
+	sort.Slice(g, func(i, j int) bool { return g[i].ID < g[j].ID })
+	return g
+}
+
+// collectGrants appends the granted operations of a list, whose path
+// starts with the provided path. It expects the latch of the node of
+// the list.
+func (l *L) collectGrants(g []Grant, ops list, path []string) []Grant {
+	for i := ops.first; i != nil; i = i.next {
+		if o := i.operation; hasPrefix(o.path, path) && granted(o) {
+			g = append(g, l.grantOf(o))
+		}
+	}
+
+	return g
+}
+
+func hasPrefix(path, prefix []string) bool {
+	if len(path) < len(prefix) {
+		return false
+	}
+
+	for i := range prefix {
+		if path[i] != prefix[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Revoke forcibly releases a lock listed by Grants. The operations
+// waiting for the revoked lock are allowed to proceed the same way as
+// if the holder had called the release function, while the release
+// function of the revoked lock becomes a no-op. It returns false if
+// the lock was already released.
+//
+func (l *L) Revoke(g Grant) bool {
+	if atomic.LoadUint32(&l.ready) == 0 {
+		return false
+	}
+
+	var n *node
+	if l.global(g.Path) {
+		n = l.tree
+		n.mx.Lock()
+	} else if n = l.findLocked(g.Path[:l.anchor(g.Path)]); n == nil {
+		return false
+	}
+
+	var o *operation
+	for i := n.operations.first; i != nil; i = i.next {
+		if no := i.operation; no.id == g.ID && claim(no, true) {
+			o = no
+			break
+		}
+	}
+
+	n.mx.Unlock()
+	if o == nil {
+		return false
+	}
+
+	l.detach(o, auditRevoke)
+	return true
+}
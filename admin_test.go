@@ -0,0 +1,119 @@
+package treelock
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGrants(t *testing.T) {
+	testRun(t, "empty", func(t *testing.T) {
+		l := new(L)
+		if g := l.Grants(); len(g) != 0 {
+			t.Error("unexpected grants", g)
+		}
+	})
+
+	testRun(t, "prefix", func(t *testing.T) {
+		l := new(L)
+		r1 := l.ReadNode("foo", "bar")
+		r2 := l.WriteTree("foo", "baz")
+		r3 := l.WriteNode("qux")
+		g := l.Grants("foo")
+		if len(g) != 2 {
+			t.Fatal("unexpected grants", g)
+		}
+
+		for _, gi := range g {
+			switch gi.Mode {
+			case "ReadNode":
+				if !reflect.DeepEqual(gi.Path, []string{"foo", "bar"}) {
+					t.Error("invalid path", gi.Path)
+				}
+			case "WriteTree":
+				if !reflect.DeepEqual(gi.Path, []string{"foo", "baz"}) {
+					t.Error("invalid path", gi.Path)
+				}
+			default:
+				t.Error("unexpected mode", gi.Mode)
+			}
+		}
+
+		r1()
+		r2()
+		r3()
+		if g := l.Grants(); len(g) != 0 {
+			t.Error("unexpected grants after release", g)
+		}
+	})
+
+	testRun(t, "waiting not listed", func(t *testing.T) {
+		l := new(L)
+		r := l.WriteNode("foo")
+		done := make(chan struct{})
+		go func() {
+			l.WriteNode("foo")()
+			close(done)
+		}()
+
+		time.Sleep(minDelay)
+		if g := l.Grants("foo"); len(g) != 1 {
+			t.Error("unexpected grants", g)
+		}
+
+		r()
+		<-done
+	})
+}
+
+func TestRevoke(t *testing.T) {
+	testRun(t, "wakes waiting", func(t *testing.T) {
+		l := new(L)
+		r := l.WriteTree("foo")
+		g := l.Grants()
+		if len(g) != 1 {
+			t.Fatal("unexpected grants", g)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			l.WriteNode("foo", "bar")()
+			close(done)
+		}()
+
+		time.Sleep(minDelay)
+		if !l.Revoke(g[0]) {
+			t.Fatal("failed to revoke")
+		}
+
+		<-done
+		r()
+		if g := l.Grants(); len(g) != 0 {
+			t.Error("unexpected grants", g)
+		}
+	})
+
+	testRun(t, "released", func(t *testing.T) {
+		l := new(L)
+		r := l.ReadNode("foo")
+		g := l.Grants()
+		r()
+		if l.Revoke(g[0]) {
+			t.Error("revoked released lock")
+		}
+	})
+
+	testRun(t, "revoked twice", func(t *testing.T) {
+		l := new(L)
+		r := l.ReadNode("foo")
+		defer r()
+		g := l.Grants()
+		if !l.Revoke(g[0]) {
+			t.Error("failed to revoke")
+		}
+
+		if l.Revoke(g[0]) {
+			t.Error("revoked twice")
+		}
+	})
+}
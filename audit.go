@@ -0,0 +1,61 @@
+package treelock
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	auditGrant   = "grant"
+	auditRelease = "release"
+	auditRevoke  = "revoke"
+
+	// the node locks replaced by an escalated tree lock are recorded
+	// with the escalate event instead of release
+	auditEscalate = "escalate"
+)
+
+type auditRecord struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	ID       uint64    `json:"id"`
+	Path     []string  `json:"path"`
+	Mode     string    `json:"mode"`
+	Owner    string    `json:"owner,omitempty"`
+	Duration int64     `json:"duration,omitempty"`
+}
+
+// audit writes a single JSON line to the audit sink. For releases and
+// revocations, the duration is the time in nanoseconds since the lock
+// was granted.
+func (l *L) audit(event string, o *operation) {
+	r := auditRecord{
+		Time:  time.Now(),
+		Event: event,
+		ID:    o.id,
+		Path:  o.path,
+		Mode:  l.modes.name(o.typ),
+	}
+
+	if r.Path == nil {
+		r.Path = []string{}
+	}
+
+	if o.owner != nil {
+		r.Owner = o.owner.label
+	}
+
+	if event != auditGrant && !o.granted.IsZero() {
+		r.Duration = int64(r.Time.Sub(o.granted))
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+
+	b = append(b, '\n')
+	l.auditMx.Lock()
+	defer l.auditMx.Unlock()
+	l.Audit.Write(b)
+}
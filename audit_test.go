@@ -0,0 +1,103 @@
+package treelock
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func readAudit(t *testing.T, b *bytes.Buffer) []auditRecord {
+	var r []auditRecord
+	s := bufio.NewScanner(b)
+	for s.Scan() {
+		var ri auditRecord
+		if err := json.Unmarshal(s.Bytes(), &ri); err != nil {
+			t.Fatal(err)
+		}
+
+		r = append(r, ri)
+	}
+
+	return r
+}
+
+func TestAudit(t *testing.T) {
+	testRun(t, "grant and release", func(t *testing.T) {
+		var b bytes.Buffer
+		l := &L{Audit: &b}
+		r := l.Owner("foo").WriteTree("bar", "baz")
+		r()
+		a := readAudit(t, &b)
+		if len(a) != 2 {
+			t.Fatal("unexpected records", a)
+		}
+
+		if a[0].Event != "grant" || a[1].Event != "release" {
+			t.Error("unexpected events", a[0].Event, a[1].Event)
+		}
+
+		for _, ai := range a {
+			if ai.Mode != "WriteTree" ||
+				ai.Owner != "foo" ||
+				!reflect.DeepEqual(ai.Path, []string{"bar", "baz"}) ||
+				ai.Time.IsZero() {
+				t.Error("unexpected record", ai)
+			}
+		}
+
+		if a[1].Duration <= 0 {
+			t.Error("missing duration")
+		}
+	})
+
+	testRun(t, "blocked", func(t *testing.T) {
+		var b bytes.Buffer
+		l := &L{Audit: &b}
+		r := l.WriteNode("foo")
+		done := make(chan struct{})
+		go func() {
+			l.ReadNode("foo")()
+			close(done)
+		}()
+
+		time.Sleep(minDelay)
+		r()
+		<-done
+		a := readAudit(t, &b)
+		var events []string
+		for _, ai := range a {
+			events = append(events, ai.Mode+" "+ai.Event)
+		}
+
+		expected := []string{
+			"WriteNode grant",
+			"WriteNode release",
+			"ReadNode grant",
+			"ReadNode release",
+		}
+
+		if !reflect.DeepEqual(events, expected) {
+			t.Error("unexpected events", events)
+		}
+	})
+
+	testRun(t, "revoke", func(t *testing.T) {
+		var b bytes.Buffer
+		l := &L{Audit: &b}
+		r := l.Owner("foo").ReadNode()
+		g := l.Grants()
+		if len(g) != 1 || g[0].Owner != "foo" {
+			t.Fatal("unexpected grants", g)
+		}
+
+		l.Revoke(g[0])
+		r()
+		a := readAudit(t, &b)
+		if len(a) != 2 || a[1].Event != "revoke" || a[1].ID != g[0].ID {
+			t.Error("unexpected records", a)
+		}
+	})
+}
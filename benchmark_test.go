@@ -0,0 +1,162 @@
+package treelock
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+type benchShape struct {
+	name  string
+	paths [][]string
+}
+
+type benchWorkload struct {
+	name  string
+	reads float64
+	tree  bool
+}
+
+type benchContention struct {
+	name     string
+	parallel bool
+
+	// hot paths, when set, limits the accessed paths to the first few
+	hotPaths int
+}
+
+type benchLocker struct {
+	name   string
+	create func() locker
+}
+
+var (
+	benchShapes = []benchShape{
+		{"wide", widePaths(1024)},
+		{"deep", deepPaths(10)},
+		{"prefixed", prefixedPaths("data", 1024)},
+	}
+
+	benchWorkloads = []benchWorkload{
+		{"node-read", 1, false},
+		{"node-read90", .9, false},
+		{"node-read50", .5, false},
+		{"tree-read", 1, true},
+		{"tree-read90", .9, true},
+		{"tree-read50", .5, true},
+	}
+
+	benchContentions = []benchContention{
+		{"sequential", false, 0},
+		{"parallel", true, 0},
+		{"parallel-hot", true, 4},
+	}
+
+	benchLockers = []benchLocker{
+		{"rwmutex", func() locker { return &testLock{mx: &sync.RWMutex{}} }},
+		{"treelock", func() locker { return new(L) }},
+		{"treelock-bias", func() locker { return &L{ReaderBias: true} }},
+	}
+
+	benchSeed int64
+)
+
+// widePaths returns the paths of a single level tree.
+func widePaths(n int) [][]string {
+	var p [][]string
+	for i := 0; i < n; i++ {
+		p = append(p, []string{fmt.Sprintf("node%d", i)})
+	}
+
+	return p
+}
+
+// prefixedPaths returns the paths of a single level tree under a
+// shared top level node, whose locks are all in the same shard.
+func prefixedPaths(prefix string, n int) [][]string {
+	p := widePaths(n)
+	for i := range p {
+		p[i] = append([]string{prefix}, p[i]...)
+	}
+
+	return p
+}
+
+// deepPaths returns the paths of the leaves of a binary tree.
+func deepPaths(depth int) [][]string {
+	p := [][]string{nil}
+	for i := 0; i < depth; i++ {
+		var next [][]string
+		for _, pi := range p {
+			for _, s := range []string{"left", "right"} {
+				next = append(next, append(append([]string(nil), pi...), s))
+			}
+		}
+
+		p = next
+	}
+
+	return p
+}
+
+// benchAccess acquires and releases a single random lock. For tree
+// locks, the locked node is a random ancestor of the selected leaf.
+func benchAccess(l locker, r *rand.Rand, paths [][]string, w benchWorkload) {
+	p := paths[r.Intn(len(paths))]
+	read := r.Float64() < w.reads
+	switch {
+	case w.tree && read:
+		l.ReadTree(p[:r.Intn(len(p)+1)]...)()
+	case w.tree:
+		l.WriteTree(p[:r.Intn(len(p)+1)]...)()
+	case read:
+		l.ReadNode(p...)()
+	default:
+		l.WriteNode(p...)()
+	}
+}
+
+func benchmarkLock(b *testing.B, l locker, s benchShape, w benchWorkload, c benchContention) {
+	paths := s.paths
+	if c.hotPaths > 0 {
+		paths = paths[:c.hotPaths]
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	if !c.parallel {
+		r := rand.New(rand.NewSource(atomic.AddInt64(&benchSeed, 1)))
+		for i := 0; i < b.N; i++ {
+			benchAccess(l, r, paths, w)
+		}
+
+		return
+	}
+
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(atomic.AddInt64(&benchSeed, 1)))
+		for pb.Next() {
+			benchAccess(l, r, paths, w)
+		}
+	})
+}
+
+// BenchmarkLock compares L to a single sync.RWMutex, across tree
+// shapes, workloads and contention levels. A subset can be selected
+// with the -bench flag, e.g. -bench 'Lock/.*/wide/node-read90/parallel$'.
+func BenchmarkLock(b *testing.B) {
+	for _, lb := range benchLockers {
+		for _, s := range benchShapes {
+			for _, w := range benchWorkloads {
+				for _, c := range benchContentions {
+					name := fmt.Sprintf("%s/%s/%s/%s", lb.name, s.name, w.name, c.name)
+					b.Run(name, func(b *testing.B) {
+						benchmarkLock(b, lb.create(), s, w, c)
+					})
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package treelock
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// readerBuckets is the number of the buckets that the fast read locks
+// are distributed across.
+const readerBuckets = 64
+
+// biasInhibitFactor tells how many times the duration of the last
+// revocation the reader bias stays disabled after a revocation.
+const biasInhibitFactor = 9
+
+// cacheLine is the assumed size of the CPU cache lines.
+const cacheLine = 64
+
+// readerBucket holds the fast read locks registered in it.
+type readerBucket struct {
+	readerBucketState
+
+	// padding to a multiple of the cache line size, to avoid false
+	// sharing between the neighboring buckets
+	_ [cacheLine - unsafe.Sizeof(readerBucketState{})%cacheLine]byte
+}
+
+type readerBucketState struct {
+	mx     sync.Mutex
+	biased bool
+	reads  []*operation
+}
+
+// readerBias holds the fast read locks of an L with ReaderBias set.
+// While the bias is enabled, ReadNode only registers the lock in one of
+// the buckets, without inserting it into the tree. The buckets are
+// picked through a sync.Pool, which makes the goroutines running on
+// the same processor use the same bucket most of the time.
+//
+// The operations that may conflict with a read lock revoke the bias:
+// they move the registered fast read locks into the tree, as granted
+// read locks, and only then insert themselves. This way they wait only
+// for the read locks that they actually conflict with. The bias is
+// enabled again by a ReadNode, when no such operations are held or
+// waiting, and the inhibition period after the last revocation has
+// passed.
+type readerBias struct {
+	mx      sync.Mutex
+	enabled uint32
+	writers int32
+	inhibit time.Time
+	next    uint32
+	indices sync.Pool
+	buckets [readerBuckets]readerBucket
+}
+
+func newReaderBias() *readerBias {
+	b := &readerBias{enabled: 1}
+	b.indices.New = func() interface{} {
+		i := int(atomic.AddUint32(&b.next, 1) % readerBuckets)
+		return &i
+	}
+
+	for i := range b.buckets {
+		b.buckets[i].biased = true
+	}
+
+	return b
+}
+
+// fastRead tells whether a lock can be acquired as a fast read lock.
+// The locks of owners are not, because their locks need to be tracked,
+// and neither are the locks of an audited L.
+func (l *L) fastRead(o *operation) bool {
+	return l.bias != nil && l.Audit == nil && o.owner == nil && o.typ == readLock
+}
+
+// read registers a fast read lock, if the bias is enabled.
+func (b *readerBias) read(o *operation) bool {
+	if atomic.LoadUint32(&b.enabled) == 0 {
+		return false
+	}
+
+	i := b.indices.Get().(*int)
+	rb := &b.buckets[*i]
+	b.indices.Put(i)
+
+	rb.mx.Lock()
+	defer rb.mx.Unlock()
+	if !rb.biased {
+		return false
+	}
+
+	o.bucket = rb
+	o.fast = true
+	o.bucketIndex = len(rb.reads)
+	rb.reads = append(rb.reads, o)
+	return true
+}
+
+// release releases a fast read lock. It returns false when the lock was
+// moved into the tree by a revocation.
+func (b *readerBias) release(o *operation) bool {
+	rb := o.bucket
+	rb.mx.Lock()
+	defer rb.mx.Unlock()
+	if !o.fast {
+		return false
+	}
+
+	last := rb.reads[len(rb.reads)-1]
+	rb.reads[o.bucketIndex] = last
+	last.bucketIndex = o.bucketIndex
+	rb.reads[len(rb.reads)-1] = nil
+	rb.reads = rb.reads[:len(rb.reads)-1]
+	o.fast = false
+	return true
+}
+
+// countWriter registers an operation that may conflict with the read
+// locks. As long as there are such operations, the bias is not enabled
+// again.
+func (b *readerBias) countWriter(o *operation) {
+	o.excludesReaders = true
+	atomic.AddInt32(&b.writers, 1)
+}
+
+func (b *readerBias) releaseWriter(o *operation) {
+	if o.excludesReaders {
+		o.excludesReaders = false
+		atomic.AddInt32(&b.writers, -1)
+	}
+}
+
+// revokeBias disables the bias, and moves the fast read locks into the
+// tree. It is called by the operations that may conflict with a read
+// lock, before they are inserted, and without holding the latches of
+// the nodes.
+func (l *L) revokeBias(o *operation) {
+	b := l.bias
+	b.countWriter(o)
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if atomic.LoadUint32(&b.enabled) == 0 {
+		return
+	}
+
+	start := time.Now()
+	atomic.StoreUint32(&b.enabled, 0)
+	for i := range b.buckets {
+		rb := &b.buckets[i]
+		rb.mx.Lock()
+		rb.biased = false
+		for j, r := range rb.reads {
+			r.fast = false
+			l.setShard(r)
+			l.insertOperation(r, false)
+			l.unblock(r, nil)
+			rb.reads[j] = nil
+		}
+
+		rb.reads = rb.reads[:0]
+		rb.mx.Unlock()
+	}
+
+	b.inhibit = time.Now().Add(biasInhibitFactor * time.Since(start))
+}
+
+// enable enables the bias again, when there are no operations that
+// may conflict with the read locks, and the inhibition period has
+// passed.
+func (b *readerBias) enable() {
+	if atomic.LoadUint32(&b.enabled) == 1 || atomic.LoadInt32(&b.writers) > 0 {
+		return
+	}
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if atomic.LoadUint32(&b.enabled) == 1 ||
+		atomic.LoadInt32(&b.writers) > 0 ||
+		time.Now().Before(b.inhibit) {
+		return
+	}
+
+	for i := range b.buckets {
+		rb := &b.buckets[i]
+		rb.mx.Lock()
+		rb.biased = true
+		rb.mx.Unlock()
+	}
+
+	atomic.StoreUint32(&b.enabled, 1)
+}
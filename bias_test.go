@@ -0,0 +1,102 @@
+package treelock
+
+import (
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestReaderBias(t *testing.T) {
+	t.Run("bucket size", func(t *testing.T) {
+		if s := unsafe.Sizeof(readerBucket{}); s%cacheLine != 0 {
+			t.Error("bucket size not a multiple of the cache line", s)
+		}
+	})
+
+	testRun(t, "fast read", func(t *testing.T) {
+		l := &L{ReaderBias: true}
+		r := l.ReadNode("foo", "bar")
+		if g := l.Grants(); len(g) != 0 {
+			t.Error("unexpected grants", g)
+		}
+
+		l.ReadNode("foo", "bar")()
+		r()
+	})
+
+	testRun(t, "write waits for fast read", func(t *testing.T) {
+		l := &L{ReaderBias: true}
+		r := l.ReadNode("foo", "bar")
+		testLocked(t, l, r, l.WriteNode, "foo", "bar")
+	})
+
+	testRun(t, "tree write waits for fast read", func(t *testing.T) {
+		l := &L{ReaderBias: true}
+		r := l.ReadNode("foo", "bar")
+		testLocked(t, l, r, l.WriteTree)
+	})
+
+	testRun(t, "revoked", func(t *testing.T) {
+		l := &L{ReaderBias: true}
+		r1 := l.ReadNode("foo", "bar")
+		r2 := l.WriteNode("baz")
+		g := l.Grants()
+		if len(g) != 2 || g[0].Mode != "ReadNode" && g[1].Mode != "ReadNode" {
+			t.Fatal("unexpected grants", g)
+		}
+
+		testLocked(t, l, r1, l.WriteNode, "foo", "bar")
+		r2()
+	})
+
+	testRun(t, "independent write", func(t *testing.T) {
+		l := &L{ReaderBias: true}
+		r := l.ReadNode("foo", "bar")
+		l.WriteNode("foo", "baz")()
+		r()
+	})
+
+	testRun(t, "read blocked after revoked", func(t *testing.T) {
+		l := &L{ReaderBias: true}
+		r := l.WriteNode("foo")
+		testLocked(t, l, r, l.ReadNode, "foo")
+	})
+
+	testRun(t, "compatible locks don't revoke", func(t *testing.T) {
+		l := &L{ReaderBias: true}
+		l.ReadTree("foo")()
+		l.UpdateNode("foo")()
+		l.IntentWrite("foo")()
+		r := l.ReadNode("foo")
+		if g := l.Grants(); len(g) != 0 {
+			t.Error("unexpected grants", g)
+		}
+
+		r()
+	})
+
+	testRun(t, "enabled again", func(t *testing.T) {
+		l := &L{ReaderBias: true}
+		l.WriteNode("foo")()
+		for {
+			r := l.ReadNode("foo")
+			g := l.Grants()
+			r()
+			if len(g) == 0 {
+				break
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	testRun(t, "owner", func(t *testing.T) {
+		l := &L{ReaderBias: true}
+		r := l.Owner("foo").ReadNode("foo")
+		if g := l.Grants(); len(g) != 1 {
+			t.Error("unexpected grants", g)
+		}
+
+		r()
+	})
+}
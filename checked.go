@@ -0,0 +1,169 @@
+package treelock
+
+// Checked acquires locks from an L instance, or on behalf of an Owner,
+// the same way as L or Owner, but when the path exceeds the limits set
+// by MaxPathDepth or MaxSegmentLength, instead of panicking, it
+// returns ErrPathTooDeep or ErrSegmentTooLong without acquiring the
+// lock. It is meant for the paths coming from untrusted sources.
+type Checked struct {
+	l     *L
+	owner *Owner
+}
+
+// Checked returns a variant of the current L instance whose methods
+// return an error when the path exceeds the limits.
+func (l *L) Checked() Checked {
+	return Checked{l: l}
+}
+
+// Checked returns a variant of the owner whose methods return an error
+// when the path exceeds the limits of L.
+func (o *Owner) Checked() Checked {
+	return Checked{l: o.l, owner: o}
+}
+
+// ReadNode acquires a read lock for an individual node, the same way
+// as L.ReadNode.
+func (c Checked) ReadNode(path ...string) (func(), error) {
+	return c.l.acquire(c.owner, false, readLock, path)
+}
+
+// WriteNode acquires a write lock for an individual node, the same way
+// as L.WriteNode.
+func (c Checked) WriteNode(path ...string) (func(), error) {
+	return c.l.acquire(c.owner, false, writeLock, path)
+}
+
+// ReadTree acquires a read lock for a subtree, the same way as
+// L.ReadTree.
+func (c Checked) ReadTree(path ...string) (func(), error) {
+	return c.l.acquire(c.owner, false, treeReadLock, path)
+}
+
+// WriteTree acquires a write lock for a subtree, the same way as
+// L.WriteTree.
+func (c Checked) WriteTree(path ...string) (func(), error) {
+	return c.l.acquire(c.owner, false, treeWriteLock, path)
+}
+
+// ReadTreeDepth acquires a read lock for a subtree up to the specified
+// depth, the same way as L.ReadTreeDepth.
+func (c Checked) ReadTreeDepth(depth int, path ...string) (func(), error) {
+	return c.l.acquireDepth(c.owner, treeReadLock, depth, path)
+}
+
+// WriteTreeDepth acquires a write lock for a subtree up to the
+// specified depth, the same way as L.WriteTreeDepth.
+func (c Checked) WriteTreeDepth(depth int, path ...string) (func(), error) {
+	return c.l.acquireDepth(c.owner, treeWriteLock, depth, path)
+}
+
+// ReadTreeExcluding acquires a read lock for a subtree, excluding the
+// subtrees of the specified descendants, the same way as
+// L.ReadTreeExcluding.
+func (c Checked) ReadTreeExcluding(path []string, excluded ...[]string) (func(), error) {
+	return c.l.acquireExcluding(c.owner, treeReadLock, path, excluded)
+}
+
+// WriteTreeExcluding acquires a write lock for a subtree, excluding the
+// subtrees of the specified descendants, the same way as
+// L.WriteTreeExcluding.
+func (c Checked) WriteTreeExcluding(path []string, excluded ...[]string) (func(), error) {
+	return c.l.acquireExcluding(c.owner, treeWriteLock, path, excluded)
+}
+
+// ReadRange acquires a read lock for a key range of children, the same
+// way as L.ReadRange.
+func (c Checked) ReadRange(from, to string, path ...string) (func(), error) {
+	return c.l.acquireRange(c.owner, rangeReadLock, from, to, path)
+}
+
+// WriteRange acquires a write lock for a key range of children, the
+// same way as L.WriteRange.
+func (c Checked) WriteRange(from, to string, path ...string) (func(), error) {
+	return c.l.acquireRange(c.owner, rangeWriteLock, from, to, path)
+}
+
+// SemaphoreNode acquires a counted lock for an individual node, the
+// same way as L.SemaphoreNode.
+func (c Checked) SemaphoreNode(limit int, path ...string) (func(), error) {
+	return c.l.acquireCounted(c.owner, semaphoreLock, limit, path)
+}
+
+// SemaphoreTree acquires a counted lock for a subtree, the same way as
+// L.SemaphoreTree.
+func (c Checked) SemaphoreTree(limit int, path ...string) (func(), error) {
+	return c.l.acquireCounted(c.owner, treeSemaphoreLock, limit, path)
+}
+
+// IntentRead acquires an intention lock for reading the subtree, the
+// same way as L.IntentRead.
+func (c Checked) IntentRead(path ...string) (func(), error) {
+	return c.l.acquire(c.owner, false, intentReadLock, path)
+}
+
+// IntentWrite acquires an intention lock for writing in the subtree,
+// the same way as L.IntentWrite.
+func (c Checked) IntentWrite(path ...string) (func(), error) {
+	return c.l.acquire(c.owner, false, intentWriteLock, path)
+}
+
+// ReadTreeIntentWrite acquires a read lock for the subtree, combined
+// with the intention to write in it, the same way as
+// L.ReadTreeIntentWrite.
+func (c Checked) ReadTreeIntentWrite(path ...string) (func(), error) {
+	return c.l.acquire(c.owner, false, treeReadIntentWriteLock, path)
+}
+
+// ReadChildren acquires a read lock for the set of the children of a
+// node, the same way as L.ReadChildren.
+func (c Checked) ReadChildren(path ...string) (func(), error) {
+	return c.l.acquire(c.owner, false, childrenReadLock, path)
+}
+
+// WriteChildren acquires a write lock for the set of the children of a
+// node, the same way as L.WriteChildren.
+func (c Checked) WriteChildren(path ...string) (func(), error) {
+	return c.l.acquire(c.owner, false, childrenWriteLock, path)
+}
+
+// UpdateNode acquires an update lock for an individual node, the same
+// way as L.UpdateNode.
+func (c Checked) UpdateNode(path ...string) (func(), error) {
+	return c.l.acquire(c.owner, false, updateLock, path)
+}
+
+// UpdateTree acquires an update lock for a subtree, the same way as
+// L.UpdateTree.
+func (c Checked) UpdateTree(path ...string) (func(), error) {
+	return c.l.acquire(c.owner, false, treeUpdateLock, path)
+}
+
+// Lock acquires a lock in a custom mode, the same way as L.Lock.
+func (c Checked) Lock(mode int, path ...string) (func(), error) {
+	return c.l.acquire(c.owner, true, lockType(mode), path)
+}
+
+// ReadNodePath acquires a read lock for the node represented by the
+// string form of its path, the same way as L.ReadNodePath.
+func (c Checked) ReadNodePath(p string) (func(), error) {
+	return c.l.acquirePath(c.owner, readLock, p)
+}
+
+// WriteNodePath acquires a write lock for the node represented by the
+// string form of its path, the same way as L.WriteNodePath.
+func (c Checked) WriteNodePath(p string) (func(), error) {
+	return c.l.acquirePath(c.owner, writeLock, p)
+}
+
+// ReadTreePath acquires a read lock for the subtree represented by the
+// string form of its path, the same way as L.ReadTreePath.
+func (c Checked) ReadTreePath(p string) (func(), error) {
+	return c.l.acquirePath(c.owner, treeReadLock, p)
+}
+
+// WriteTreePath acquires a write lock for the subtree represented by
+// the string form of its path, the same way as L.WriteTreePath.
+func (c Checked) WriteTreePath(p string) (func(), error) {
+	return c.l.acquirePath(c.owner, treeWriteLock, p)
+}
@@ -0,0 +1,154 @@
+package treelock
+
+// maxListedChildren is the number of children up to which they are
+// stored in a slice. Beyond it, they are indexed by a map.
+const maxListedChildren = 8
+
+// maxIdleStrings is the size of the interned strings map, beyond which
+// the map is dropped when it becomes empty, to release its memory.
+const maxIdleStrings = 1024
+
+type child struct {
+	key  string
+	node *node
+}
+
+// children holds the child nodes of a node. Most nodes have only a few
+// children, and for them a slice searched linearly takes less memory
+// than a map, and it is not slower.
+type children struct {
+	list  []child
+	index map[string]*node
+}
+
+// interner holds a single instance of the path segments used as the
+// keys of the nodes, counting the nodes that use them. This way, the
+// keys of the nodes don't keep the segments of every path alive, that
+// were used to create them. Interning happens only when creating new
+// nodes.
+type interner struct {
+	strings map[string]interned
+	peak    int
+}
+
+type interned struct {
+	s    string
+	refs int
+}
+
+func (c *children) get(key string) *node {
+	if c.index != nil {
+		return c.index[key]
+	}
+
+	for _, ci := range c.list {
+		if ci.key == key {
+			return ci.node
+		}
+	}
+
+	return nil
+}
+
+func (c *children) add(key string, n *node) {
+	if c.index != nil {
+		c.index[key] = n
+		return
+	}
+
+	if len(c.list) < maxListedChildren {
+		c.list = append(c.list, child{key: key, node: n})
+		return
+	}
+
+	c.index = make(map[string]*node, len(c.list)+1)
+	for _, ci := range c.list {
+		c.index[ci.key] = ci.node
+	}
+
+	c.index[key] = n
+	c.clearList()
+}
+
+func (c *children) remove(key string) {
+	if c.index == nil {
+		for i, ci := range c.list {
+			if ci.key == key {
+				last := len(c.list) - 1
+				c.list[i] = c.list[last]
+				c.list[last] = child{}
+				c.list = c.list[:last]
+				return
+			}
+		}
+
+		return
+	}
+
+	delete(c.index, key)
+	if len(c.index) > maxListedChildren/2 {
+		return
+	}
+
+	for k, n := range c.index {
+		c.list = append(c.list, child{key: k, node: n})
+	}
+
+	c.index = nil
+}
+
+func (c *children) clearList() {
+	for i := range c.list {
+		c.list[i] = child{}
+	}
+
+	c.list = c.list[:0]
+}
+
+func (c *children) each(f func(*node)) {
+	if c.index != nil {
+		for _, n := range c.index {
+			f(n)
+		}
+
+		return
+	}
+
+	for _, ci := range c.list {
+		f(ci.node)
+	}
+}
+
+func (in *interner) intern(s string) string {
+	if in.strings == nil {
+		in.strings = make(map[string]interned)
+	}
+
+	i, ok := in.strings[s]
+	if !ok {
+		i.s = s
+	}
+
+	i.refs++
+	in.strings[s] = i
+	if len(in.strings) > in.peak {
+		in.peak = len(in.strings)
+	}
+
+	return i.s
+}
+
+func (in *interner) release(s string) {
+	i := in.strings[s]
+	i.refs--
+	if i.refs > 0 {
+		in.strings[s] = i
+		return
+	}
+
+	delete(in.strings, s)
+	if len(in.strings) == 0 && in.peak > maxIdleStrings {
+		in.strings = nil
+		in.peak = 0
+	}
+}
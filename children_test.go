@@ -0,0 +1,81 @@
+package treelock
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestChildren(t *testing.T) {
+	var c children
+	nodes := make(map[string]*node)
+	for i := 0; i < 3*maxListedChildren; i++ {
+		key := fmt.Sprint(i)
+		nodes[key] = &node{}
+		c.add(key, nodes[key])
+		for k, n := range nodes {
+			if c.get(k) != n {
+				t.Fatal("child not found", k)
+			}
+		}
+	}
+
+	if c.index == nil {
+		t.Error("children not indexed")
+	}
+
+	for k := range nodes {
+		c.remove(k)
+		delete(nodes, k)
+		if c.get(k) != nil {
+			t.Fatal("removed child found", k)
+		}
+
+		var count int
+		c.each(func(*node) { count++ })
+		if count != len(nodes) {
+			t.Fatal("unexpected number of children", count, len(nodes))
+		}
+	}
+
+	if c.index != nil || len(c.list) != 0 {
+		t.Error("children not cleared")
+	}
+}
+
+func TestInterner(t *testing.T) {
+	var in interner
+	in.intern("foo")
+	in.intern("foo")
+	in.intern("bar")
+	in.release("foo")
+	if len(in.strings) != 2 {
+		t.Error("released too early")
+	}
+
+	in.release("foo")
+	in.release("bar")
+	if len(in.strings) != 0 {
+		t.Error("not released")
+	}
+
+	l := new(L)
+	var r []func()
+	for i := 0; i < 3; i++ {
+		r = append(r, l.ReadNode("users", fmt.Sprint(i), "settings"))
+	}
+
+	s := &l.shards[shardIndex("settings")].strings
+	if s.strings["settings"].refs != 3 {
+		t.Error("segment not interned", s.strings)
+	}
+
+	for _, ri := range r {
+		ri()
+	}
+
+	for i := range l.shards {
+		if s := l.shards[i].strings; len(s.strings) != 0 {
+			t.Error("interned segments not released", s.strings)
+		}
+	}
+}
@@ -7,6 +7,26 @@ The package can be used with tree structures whose nodes can be referenced by th
 system, a file with the path /a/b/c can be locked with the treelock path of "a", "b", "c", while an empty
 treelock path would mean locking the root: /.
 
+The string form of the paths can be parsed with ParsePath, according to the PathSyntax field of L, or used
+directly with WriteNodePath and the other methods accepting the string form. The parsing cleans the paths, so
+e.g. "/a//b/" and "/a/b" lock the same node, and it can fold the case of the segments.
+
+When the segments considered equal by the protected store differ, e.g. on a case-insensitive file system, the
+Canonical field of L can map them to the same form, so that they refer to the same node. E.g. with
+strings.ToLower, the locks on "Docs" and "docs" conflict.
+
+When the Wildcard field of L is set, path segments equal to it match any segment. E.g. with a wildcard of "*",
+the path "users", "*", "settings" locks the settings of every user, without enumerating the users, while the
+rest of the data of the users remains available.
+
+With Go 1.22 or newer, Of can be used for trees whose nodes are referenced by keys of other comparable types than
+string, e.g. numeric IDs: new(Of[uint64]).WriteNode(42, 7).
+
+Paths of any depth are handled without recursion. When the paths come from untrusted sources, the MaxPathDepth
+and MaxSegmentLength fields of L can limit their size. The lock methods panic when a path exceeds the limits, so
+such paths should be acquired through Checked, whose methods return an error instead, or validated first with
+CheckPath.
+
 Read and write
 
 The package assumes that the nodes of the protected tree structure allow multiple concurrent read operations,
@@ -25,10 +45,74 @@ ReadTree or WriteTree need to be used. E.g. in case of a file system, when an op
 directory structure to under another path, it needs to acquire a ReadTree lock on the source directory, and a
 WriteTree lock on the destination.
 
+Between the two, ReadChildren and WriteChildren lock only the set of the children of a node, without locking the
+node itself or the content of its existing children. E.g. in case of a file system, listing a directory requires
+a ReadChildren lock, while creating or deleting a file in it requires a WriteChildren lock.
+
+ReadTreeDepth and WriteTreeDepth lock a subtree only up to a given depth, e.g. a directory and the files
+directly in it, while the deeper nodes remain available for other operations. Similarly, ReadTreeExcluding and
+WriteTreeExcluding lock a subtree except for the subtrees of selected descendants.
+
+ReadRange and WriteRange lock the children of a node whose key falls in a lexicographic range, whether the
+children exist or not. This protects range scans over sorted keys against concurrently created children.
+
+SemaphoreNode and SemaphoreTree acquire counted locks, that allow up to a given number of concurrent holders on
+a node or a subtree, while they still exclude, and are excluded by, the write locks.
+
+Intention locks
+
+Following the classical multi-granularity locking scheme, IntentRead and IntentWrite declare that the holder is
+going to read or write some nodes in the subtree, blocking only the operations that would lock the whole subtree
+in a conflicting way. ReadTreeIntentWrite reads the whole subtree while declaring that selected nodes in it are
+going to be written.
+
+Custom modes
+
+Instead of the built-in lock types, an L instance can be configured with custom lock modes, by setting the Modes
+and the Compatible fields, and acquiring the locks with the Lock method. Each mode applies either to the locked
+node only, to its subtree, to the path leading to it, or only to the set of its children, and two operations
+block each other when they affect the same node, or the same set of children, in incompatible modes.
+
+Owners
+
+Locks can be acquired through an Owner, too. An owner has a label that identifies it in the audit log and in the
+list of grants, and the locks acquired by the same owner don't block each other. This allows, e.g., writing the
+nodes in a subtree locked by ReadTreeIntentWrite, or converting a read lock into a write lock. To avoid deadlocks
+when multiple operations read a node and then may decide to write it, they need to use UpdateNode, that allows
+concurrent readers but only a single update lock, and then convert it into a write lock.
+
+When the EscalationThreshold field of L is set, and an owner accumulates more node locks on the children of a
+node than the threshold, the node locks are replaced by a single tree lock of the owner on the parent node. The
+escalation happens only when the tree lock can be granted without waiting, otherwise it is retried with the next
+node lock, and the locks on the children of the root node are not escalated.
+
 Fairness
 
 Operations affecting the same nodes will be allowed to proceed in the same order as they requested the lock,
 regardless of the type of the lock. Operations affecting independent nodes will be allowed to proceed as soon as
 the affected node becomes available.
+
+The exception is an Owner that already holds a lock: its new locks take precedence over the conflicting
+operations that are still waiting, to allow converting and extending its locks without deadlocks. This way, an
+owner that keeps holding some lock while requesting new ones can delay the waiting operations without limit, so
+the owners should release all their locks from time to time.
+
+Concurrency
+
+The internal bookkeeping of the locks is kept on the nodes of the tree, each node having its own latch. An
+operation descends from the top level node of its path to the locked node, taking the latches hand over hand, so
+the lock operations in disjoint subtrees don't serialize each other, even under the same top level node, e.g.
+"data", "a" and "data", "b". They only pass through the latches of their common ancestors, and only for the time
+of checking and registering the locks on them. A lock on a path containing a wildcard is registered on the node
+of the longest prefix of its path without wildcards.
+
+The locks on the root node, and on paths starting with a wildcard, are handled exclusively of the other lock
+operations, by taking the latch of every top level subtree, therefore they are more expensive. While no such locks
+are held, the other operations don't need to check them. When custom modes with ScopePath are used, every lock is
+handled this way, because the path scoped locks apply to the root node, too.
+
+For read-mostly trees, the ReaderBias field of L makes ReadNode cheaper, as long as no conflicting locks are
+requested. The first such request revokes the bias, and the reads are queued again the usual way, until some
+time after the conflicting locks were released.
 */
 package treelock
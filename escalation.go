@@ -0,0 +1,235 @@
+package treelock
+
+// escalation tracks the node locks of an owner on the children of a
+// single node, and, once their number exceeded the threshold, the tree
+// lock that replaces them. Its fields are protected by the mutex of the
+// owner.
+type escalation struct {
+	owner      *Owner
+	node       *node
+	path       []string
+	ops        map[*operation]struct{}
+	writes     int
+	tree       *operation
+	refs       int
+	escalating bool
+}
+
+// escalates tells whether a lock can be escalated. The node locks on
+// the children of the root are not escalated, because the tree lock of
+// the root would be global, while the node locks belong to the shards.
+// Neither are the locks on paths with wildcards.
+func (l *L) escalates(o *operation) bool {
+	return l.EscalationThreshold > 0 &&
+		!l.modes.custom &&
+		o.owner != nil &&
+		len(o.path) > 1 &&
+		(o.typ == readLock || o.typ == writeLock) &&
+		!o.global &&
+		l.anchor(o.path) == len(o.path)
+}
+
+// absorb checks whether the requested node lock is covered by the tree
+// lock of an escalation, and if it is, it registers the node lock with
+// the escalation, without inserting it into the tree.
+func (l *L) absorb(o *operation) bool {
+	if !l.escalates(o) {
+		return false
+	}
+
+	ow := o.owner
+	ow.mx.Lock()
+	hasEscalations := len(ow.escalations) > 0
+	ow.mx.Unlock()
+	if !hasEscalations {
+		return false
+	}
+
+	n := l.findLocked(o.path[:len(o.path)-1])
+	if n == nil {
+		return false
+	}
+
+	defer n.mx.Unlock()
+	ow.mx.Lock()
+	defer ow.mx.Unlock()
+	e := ow.escalations[n]
+	if e == nil || e.tree == nil {
+		return false
+	}
+
+	if e.tree.typ == treeReadLock && o.typ != readLock {
+		return false
+	}
+
+	o.escalation = e
+	o.absorbed = true
+	o.released = true
+	e.refs++
+	return true
+}
+
+// track registers a node lock of an owner with the escalation of the
+// parent node. It expects the latch of the parent node, which can't be
+// removed from the tree while the escalation has node locks or a tree
+// lock.
+func (l *L) track(n *node, o *operation) {
+	ow := o.owner
+	ow.mx.Lock()
+	defer ow.mx.Unlock()
+	e := ow.escalations[n]
+	if e == nil {
+		e = &escalation{
+			owner: ow,
+			node:  n,
+			path:  append([]string(nil), o.path[:len(o.path)-1]...),
+			ops:   make(map[*operation]struct{}),
+		}
+
+		if ow.escalations == nil {
+			ow.escalations = make(map[*node]*escalation)
+		}
+
+		ow.escalations[n] = e
+	}
+
+	o.escalation = e
+	e.ops[o] = struct{}{}
+	if o.typ == writeLock {
+		e.writes++
+	}
+}
+
+func (e *escalation) untrack(o *operation) {
+	e.owner.mx.Lock()
+	defer e.owner.mx.Unlock()
+	if _, ok := e.ops[o]; !ok {
+		return
+	}
+
+	delete(e.ops, o)
+	if o.typ == writeLock {
+		e.writes--
+	}
+}
+
+// detachTree detaches a released tree lock from the escalation, and
+// the escalation from the node.
+func (e *escalation) detachTree(tree *operation) {
+	e.owner.mx.Lock()
+	defer e.owner.mx.Unlock()
+	if e.tree != tree {
+		return
+	}
+
+	e.tree = nil
+	if e.owner.escalations[e.node] == e {
+		delete(e.owner.escalations, e.node)
+	}
+}
+
+// escalate replaces the node locks of an escalation with a tree lock,
+// when their number exceeds the threshold. The escalation happens only
+// when all the node locks were granted, and the tree lock can be
+// granted immediately, otherwise it is retried with the next node lock
+// of the owner on the same children.
+func (l *L) escalate(e *escalation) {
+	ow := e.owner
+	ow.mx.Lock()
+	if ow.escalations[e.node] != e ||
+		e.tree != nil ||
+		e.escalating ||
+		len(e.ops) <= l.EscalationThreshold {
+		ow.mx.Unlock()
+		return
+	}
+
+	// only the granted node locks can be replaced, otherwise the
+	// waiting ones would be released without ever being granted
+	for eo := range e.ops {
+		if !granted(eo) {
+			ow.mx.Unlock()
+			return
+		}
+	}
+
+	typ := treeReadLock
+	if e.writes > 0 {
+		typ = treeWriteLock
+	}
+
+	e.escalating = true
+	ow.mx.Unlock()
+
+	tree := &operation{
+		owner:  ow,
+		typ:    typ,
+		path:   e.path,
+		depth:  unlimitedDepth,
+		treeOf: e,
+	}
+
+	l.setShard(tree)
+
+	// the bias was already revoked by the write locks that the tree
+	// lock replaces, but it needs to be counted
+	if l.bias != nil && typ == treeWriteLock {
+		l.bias.countWriter(tree)
+	}
+
+	ok := l.insertOperation(tree, true) && l.tryGrant(tree)
+
+	// when the node locks were released meanwhile, the escalation was
+	// detached from the node, and the tree lock is not used
+	var absorbed []*operation
+	ow.mx.Lock()
+	e.escalating = false
+	used := ok && ow.escalations[e.node] == e
+	if used {
+		e.tree = tree
+		for eo := range e.ops {
+			if granted(eo) {
+				eo.absorbed = true
+				e.refs++
+				absorbed = append(absorbed, eo)
+			}
+		}
+	}
+
+	ow.mx.Unlock()
+	switch {
+	case !ok:
+		l.releaseOperation(tree, "")
+	case !used:
+		l.releaseOperation(tree, auditRelease)
+	}
+
+	for _, eo := range absorbed {
+		l.releaseOperation(eo, auditEscalate)
+	}
+
+	l.finishEscalation(e)
+}
+
+// finishEscalation releases the tree lock of the escalation, when all
+// the node locks that it covers were released. The escalation is
+// detached from the node, because the node may be reused afterwards.
+func (l *L) finishEscalation(e *escalation) {
+	ow := e.owner
+	ow.mx.Lock()
+	if e.refs > 0 || len(e.ops) > 0 {
+		ow.mx.Unlock()
+		return
+	}
+
+	if ow.escalations[e.node] == e {
+		delete(ow.escalations, e.node)
+	}
+
+	tree := e.tree
+	e.tree = nil
+	ow.mx.Unlock()
+	if tree != nil {
+		l.releaseOperation(tree, auditRelease)
+	}
+}
@@ -0,0 +1,221 @@
+package treelock
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEscalation(t *testing.T) {
+	testRun(t, "below threshold", func(t *testing.T) {
+		l := &L{EscalationThreshold: 3}
+		o := l.Owner("foo")
+		r1 := o.WriteNode("foo", "bar")
+		r2 := o.WriteNode("foo", "baz")
+		r3 := o.WriteNode("foo", "qux")
+		if g := l.Grants(); len(g) != 3 {
+			t.Error("unexpected grants", g)
+		}
+
+		r4 := l.WriteNode("foo", "quux")
+		r4()
+		r3()
+		r2()
+		r1()
+	})
+
+	testRun(t, "escalated", func(t *testing.T) {
+		l := &L{EscalationThreshold: 2}
+		o := l.Owner("foo")
+		var r []func()
+		for _, p := range []string{"a", "b", "c", "d"} {
+			r = append(r, o.WriteNode("foo", p))
+		}
+
+		g := l.Grants()
+		if len(g) != 1 || g[0].Mode != "WriteTree" || len(g[0].Path) != 1 || g[0].Path[0] != "foo" {
+			t.Fatal("unexpected grants", g)
+		}
+
+		r[0]()
+		r[1]()
+		r[2]()
+		testLocked(t, l, r[3], l.ReadNode, "foo", "e")
+		if g := l.Grants(); len(g) != 0 {
+			t.Error("unexpected grants", g)
+		}
+	})
+
+	testRun(t, "read", func(t *testing.T) {
+		l := &L{EscalationThreshold: 1}
+		o := l.Owner("foo")
+		r1 := o.ReadNode("foo", "bar")
+		r2 := o.ReadNode("foo", "baz")
+		g := l.Grants()
+		if len(g) != 1 || g[0].Mode != "ReadTree" {
+			t.Fatal("unexpected grants", g)
+		}
+
+		r3 := l.ReadNode("foo", "qux")
+		r3()
+		r1()
+		testLocked(t, l, r2, l.WriteNode, "foo", "qux")
+	})
+
+	testRun(t, "write under read", func(t *testing.T) {
+		l := &L{EscalationThreshold: 1}
+		o := l.Owner("foo")
+		r1 := o.ReadNode("foo", "bar")
+		r2 := o.ReadNode("foo", "baz")
+		r3 := o.WriteNode("foo", "qux")
+		if g := l.Grants(); len(g) != 2 {
+			t.Fatal("unexpected grants", g)
+		}
+
+		r1()
+		r2()
+		testLocked(t, l, r3, l.ReadNode, "foo", "qux")
+	})
+
+	testRun(t, "deferred while others hold", func(t *testing.T) {
+		l := &L{EscalationThreshold: 1}
+		o := l.Owner("foo")
+		r1 := o.WriteNode("foo", "bar")
+		r2 := l.ReadNode("foo", "baz")
+		r3 := o.WriteNode("foo", "qux")
+		if g := l.Grants(); len(g) != 3 {
+			t.Fatal("unexpected grants", g)
+		}
+
+		r2()
+		r4 := o.WriteNode("foo", "quux")
+		if g := l.Grants(); len(g) != 1 || g[0].Mode != "WriteTree" {
+			t.Fatal("unexpected grants", g)
+		}
+
+		r4()
+		r3()
+		r1()
+		if g := l.Grants(); len(g) != 0 {
+			t.Error("unexpected grants", g)
+		}
+	})
+
+	testRun(t, "no deadlock with own locks", func(t *testing.T) {
+		l := &L{EscalationThreshold: 1}
+		o := l.Owner("foo")
+		r1 := l.ReadNode("a", "b", "z")
+		r2 := o.WriteNode("a", "b", "1")
+		r3 := o.ReadNode("a", "b", "2")
+		r3()
+		r2()
+		r1()
+	})
+
+	testRun(t, "waiting node lock not escalated", func(t *testing.T) {
+		l := &L{EscalationThreshold: 1}
+		o := l.Owner("foo")
+		r1 := l.WriteNode("a", "c")
+		tree := make(chan struct{})
+		go func() {
+			l.ReadTree("a")()
+			close(tree)
+		}()
+
+		time.Sleep(minDelay)
+		node := make(chan struct{})
+		go func() {
+			o.WriteNode("a", "b", "1")()
+			close(node)
+		}()
+
+		time.Sleep(minDelay)
+		r2 := o.WriteNode("a", "b", "2")
+		for _, g := range l.Grants() {
+			if g.Mode == "WriteTree" {
+				t.Fatal("escalated with a waiting node lock")
+			}
+		}
+
+		r1()
+		r2()
+		<-tree
+		<-node
+		if g := l.Grants(); len(g) != 0 {
+			t.Error("unexpected grants", g)
+		}
+	})
+
+	testRun(t, "revoked", func(t *testing.T) {
+		l := &L{EscalationThreshold: 1}
+		o := l.Owner("foo")
+		r1 := o.IntentWrite("a", "b")
+		r2 := o.WriteNode("a", "b", "1")
+		r3 := o.WriteNode("a", "b", "2")
+		var tree Grant
+		for _, g := range l.Grants() {
+			if g.Mode == "WriteTree" {
+				tree = g
+			}
+		}
+
+		if !l.Revoke(tree) {
+			t.Fatal("failed to revoke the tree lock")
+		}
+
+		r4 := o.WriteNode("a", "b", "3")
+		testLocked(t, l, r4, l.WriteNode, "a", "b", "3")
+		r3()
+		r2()
+		r1()
+		if g := l.Grants(); len(g) != 0 {
+			t.Error("unexpected grants", g)
+		}
+
+		if len(o.escalations) != 0 {
+			t.Error("escalation not finished")
+		}
+	})
+
+	testRun(t, "escalated again after revoked", func(t *testing.T) {
+		l := &L{EscalationThreshold: 1}
+		o := l.Owner("foo")
+		r1 := o.WriteNode("a", "b", "1")
+		r2 := o.WriteNode("a", "b", "2")
+		g := l.Grants()
+		if len(g) != 1 || g[0].Mode != "WriteTree" {
+			t.Fatal("unexpected grants", g)
+		}
+
+		if !l.Revoke(g[0]) {
+			t.Fatal("failed to revoke the tree lock")
+		}
+
+		// the released nodes may be reused for other paths, while
+		// the absorbed node locks are still held
+		r3 := o.WriteNode("a", "x", "y", "1")
+		r4 := o.WriteNode("a", "x", "y", "2")
+		g = l.Grants()
+		if len(g) != 1 || g[0].Mode != "WriteTree" || strings.Join(g[0].Path, "/") != "a/x/y" {
+			t.Fatal("unexpected grants", g)
+		}
+
+		r4()
+		r3()
+		r2()
+		r1()
+		if g := l.Grants(); len(g) != 0 {
+			t.Error("unexpected grants", g)
+		}
+	})
+
+	testRun(t, "other owners", func(t *testing.T) {
+		l := &L{EscalationThreshold: 1}
+		r1 := l.Owner("foo").WriteNode("foo", "bar")
+		r2 := l.Owner("bar").WriteNode("foo", "baz")
+		r3 := l.WriteNode("foo", "qux")
+		r3()
+		r2()
+		r1()
+	})
+}
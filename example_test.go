@@ -1,14 +1,9 @@
 package treelock_test
 
-import (
-	"strings"
-
-	"github.com/aryszka/treelock"
-)
+import "github.com/aryszka/treelock"
 
 func writeFile(l *treelock.L, path string) {
-	p := strings.Split(path, "/")[1:]
-	release := l.WriteNode(p...)
+	release := l.WriteNodePath(path)
 	defer release()
 	// write to file with path
 }
@@ -184,7 +184,7 @@ func buildTree() *testNode {
 
 		for i := 0; i < nodes; i++ {
 			c := &testNode{}
-			n.children[string('a'+i)] = c
+			n.children[string(rune('a'+i))] = c
 			createChildren(level+1, c)
 		}
 	}
@@ -229,9 +229,8 @@ func groupPaths(paths [][]string) [][][]string {
 	return gpaths
 }
 
-func testLockFuzzy(t *testing.T, d time.Duration) {
+func testLockFuzzy(t *testing.T, l *L, d time.Duration) {
 	before := cnt.value()
-	l := new(L)
 	// l := &testLock{mx: &sync.RWMutex{}}
 	tree := buildTree()
 	paths := getAllPaths(tree)
@@ -267,7 +266,7 @@ func TestLockFuzzy(t *testing.T) {
 		t.Skip()
 	}
 
-	testLockFuzzy(t, fuzzyDuration)
+	testLockFuzzy(t, new(L), fuzzyDuration)
 }
 
 func TestLockFuzzyShort(t *testing.T) {
@@ -275,5 +274,13 @@ func TestLockFuzzyShort(t *testing.T) {
 		t.Skip()
 	}
 
-	testLockFuzzy(t, shortFuzzyDuration)
+	testLockFuzzy(t, new(L), shortFuzzyDuration)
+}
+
+func TestLockFuzzyReaderBias(t *testing.T) {
+	if testing.CoverMode() != "" || !testing.Short() {
+		t.Skip()
+	}
+
+	testLockFuzzy(t, &L{ReaderBias: true}, shortFuzzyDuration)
 }
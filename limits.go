@@ -0,0 +1,99 @@
+package treelock
+
+import "errors"
+
+var (
+	// ErrPathTooDeep is returned by CheckPath when the path has more
+	// segments than L.MaxPathDepth.
+	ErrPathTooDeep = errors.New("treelock: path too deep")
+
+	// ErrSegmentTooLong is returned by CheckPath when a segment of the
+	// path is longer than L.MaxSegmentLength.
+	ErrSegmentTooLong = errors.New("treelock: path segment too long")
+)
+
+// CheckPath returns an error when the path exceeds the limits set by
+// MaxPathDepth or MaxSegmentLength. The lock methods panic with the
+// same errors, therefore paths coming from untrusted sources should be
+// checked before acquiring a lock with them, or the locks should be
+// acquired through Checked.
+func (l *L) CheckPath(path ...string) error {
+	if !l.limited() {
+		return nil
+	}
+
+	if l.MaxPathDepth > 0 && len(path) > l.MaxPathDepth {
+		return ErrPathTooDeep
+	}
+
+	for _, s := range path {
+		if err := l.checkSegment(s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l *L) limited() bool {
+	return l.MaxPathDepth > 0 || l.MaxSegmentLength > 0
+}
+
+func (l *L) checkSegment(s string) error {
+	if l.MaxSegmentLength > 0 && len(s) > l.MaxSegmentLength {
+		return ErrSegmentTooLong
+	}
+
+	return nil
+}
+
+// checkExcluded validates the path of an operation and its excluded
+// paths, that are relative to the path of the operation.
+func (l *L) checkExcluded(path []string, excluded [][]string) error {
+	if !l.limited() {
+		return nil
+	}
+
+	if err := l.CheckPath(path...); err != nil {
+		return err
+	}
+
+	for _, e := range excluded {
+		if l.MaxPathDepth > 0 && len(path)+len(e) > l.MaxPathDepth {
+			return ErrPathTooDeep
+		}
+
+		for _, s := range e {
+			if err := l.checkSegment(s); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkRange validates the path of a range lock and the keys of the
+// range.
+func (l *L) checkRange(path []string, from, to string) error {
+	if err := l.CheckPath(path...); err != nil {
+		return err
+	}
+
+	if err := l.checkSegment(from); err != nil {
+		return err
+	}
+
+	return l.checkSegment(to)
+}
+
+// must panics with the error of validating the path of an operation,
+// when acquiring the lock through L or an Owner, instead of Checked.
+// Nothing is allocated for the operation in this case.
+func must(release func(), err error) func() {
+	if err != nil {
+		panic(err)
+	}
+
+	return release
+}
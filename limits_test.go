@@ -0,0 +1,131 @@
+package treelock
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	testRun(t, "check path", func(t *testing.T) {
+		l := &L{MaxPathDepth: 3, MaxSegmentLength: 4}
+		for _, test := range []struct {
+			path []string
+			err  error
+		}{
+			{nil, nil},
+			{[]string{"foo", "bar", "baz"}, nil},
+			{[]string{"foo", "bar", "baz", "qux"}, ErrPathTooDeep},
+			{[]string{"foo", "quux"}, nil},
+			{[]string{"foo", "quuux"}, ErrSegmentTooLong},
+		} {
+			if err := l.CheckPath(test.path...); err != test.err {
+				t.Error("unexpected error", test.path, err)
+			}
+		}
+	})
+
+	testRun(t, "no limits", func(t *testing.T) {
+		l := new(L)
+		if err := l.CheckPath(strings.Split(strings.Repeat("foo/", 1<<10), "/")...); err != nil {
+			t.Error(err)
+		}
+	})
+
+	testRun(t, "lock panics", func(t *testing.T) {
+		l := &L{MaxPathDepth: 3, MaxSegmentLength: 4}
+		for _, test := range []struct {
+			name string
+			lock func() func()
+			err  error
+		}{
+			{"node", func() func() { return l.WriteNode("foo", "bar", "baz", "qux") }, ErrPathTooDeep},
+			{"tree", func() func() { return l.ReadTree("quuux") }, ErrSegmentTooLong},
+			{"depth", func() func() { return l.ReadTreeDepth(1, "foo", "bar", "baz", "qux") }, ErrPathTooDeep},
+			{"range", func() func() { return l.ReadRange("a", "quuux", "foo") }, ErrSegmentTooLong},
+			{"semaphore", func() func() { return l.SemaphoreNode(2, "foo", "quuux") }, ErrSegmentTooLong},
+			{"excluded", func() func() {
+				return l.WriteTreeExcluding([]string{"foo"}, []string{"bar", "baz", "qux"})
+			}, ErrPathTooDeep},
+		} {
+			t.Run(test.name, func(t *testing.T) {
+				defer func() {
+					if err := recover(); err != test.err {
+						t.Error("unexpected panic", err)
+					}
+				}()
+
+				test.lock()
+			})
+		}
+
+		// the failed locks don't leave anything behind
+		l.WriteTree()()
+	})
+
+	testRun(t, "checked", func(t *testing.T) {
+		l := &L{MaxPathDepth: 3, MaxSegmentLength: 4}
+		for _, test := range []struct {
+			name string
+			lock func() (func(), error)
+			err  error
+		}{
+			{"node", func() (func(), error) { return l.Checked().WriteNode("foo", "bar", "baz", "qux") }, ErrPathTooDeep},
+			{"valid", func() (func(), error) { return l.Checked().WriteNode("foo", "bar", "baz") }, nil},
+			{"owner", func() (func(), error) { return l.Owner("foo").Checked().ReadTree("quuux") }, ErrSegmentTooLong},
+			{"range", func() (func(), error) { return l.Checked().ReadRange("a", "quuux", "foo") }, ErrSegmentTooLong},
+			{"excluded", func() (func(), error) {
+				return l.Checked().WriteTreeExcluding([]string{"foo"}, []string{"bar", "baz", "qux"})
+			}, ErrPathTooDeep},
+			{"string form", func() (func(), error) { return l.Checked().WriteNodePath("/a/b/c/d") }, ErrPathTooDeep},
+			{"string form valid", func() (func(), error) { return l.Checked().WriteNodePath("/a/b/c/../d") }, nil},
+			{"string form dropped", func() (func(), error) { return l.Checked().WriteNodePath("/a/b/c/d/../..") }, ErrPathTooDeep},
+			{"string form segment", func() (func(), error) { return l.Checked().ReadTreePath("/a/quuux") }, ErrSegmentTooLong},
+		} {
+			t.Run(test.name, func(t *testing.T) {
+				r, err := test.lock()
+				if err != test.err {
+					t.Fatal("unexpected error", err)
+				}
+
+				if err == nil {
+					r()
+				} else if r != nil {
+					t.Error("unexpected release function")
+				}
+			})
+		}
+
+		if g := l.Grants(); len(g) != 0 {
+			t.Error("unexpected grants", g)
+		}
+
+		if g := l.Grants("foo", "bar", "baz", "qux"); g != nil {
+			t.Error("unexpected grants", g)
+		}
+	})
+
+	testRun(t, "string form panics", func(t *testing.T) {
+		l := &L{MaxPathDepth: 3}
+		defer func() {
+			if err := recover(); err != ErrPathTooDeep {
+				t.Error("unexpected panic", err)
+			}
+		}()
+
+		l.WriteNodePath(strings.Repeat("/foo", 1<<20))
+	})
+
+	testRun(t, "very deep path", func(t *testing.T) {
+		l := new(L)
+		p := strings.Split(strings.Repeat("foo/", 1<<17), "/")
+		r1 := l.ReadNode(p...)
+		r2 := l.ReadTree(p[:1<<16]...)
+		if g := l.Grants(); len(g) != 2 {
+			t.Error("unexpected grants", len(g))
+		}
+
+		r1()
+		r2()
+		l.WriteTree()()
+	})
+}
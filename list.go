@@ -1,104 +1,46 @@
 package treelock
 
+// item is the entry of an operation in a list of a node. An operation
+// has an item for every node on the path to the node where it is
+// anchored, and each item belongs to the list of a single node, this
+// way the lists of different nodes can be changed independently.
 type item struct {
 	operation  *operation
 	prev, next *item
 }
 
-type listRange struct {
+// list holds the items of a node in the order of their insertion.
+type list struct {
 	first, last *item
 }
 
-func (l listRange) empty() bool {
+func (l list) empty() bool {
 	return l.first == nil
 }
 
-func rangeOver(l listRange, f func(*operation)) {
-	if l.first == nil {
-		return
-	}
-
-	i := l.first
-	for {
-		f(i.operation)
-		if i == l.last {
-			return
-		}
-
-		i = i.next
-	}
-}
-
-func insertTo(l listRange, i *item) listRange {
-	if l.empty() {
-		l.first, l.last = i, i
-		return l
-	}
-
-	if l.first == i.next {
+func (l *list) push(i *item) {
+	i.prev, i.next = l.last, nil
+	if l.last == nil {
 		l.first = i
-		return l
+	} else {
+		l.last.next = i
 	}
 
-	if l.last == i.prev {
-		l.last = i
-		return l
-	}
-
-	if i.prev != nil {
-		return l
-	}
-
-	if l.last.next != nil {
-		i.next = l.last.next
-		l.last.next.prev = i
-	}
-
-	l.last.next = i
-	i.prev = l.last
 	l.last = i
-	return l
 }
 
-func removeFrom(l listRange, i *item) listRange {
-	if i.prev != nil {
+func (l *list) remove(i *item) {
+	if i.prev == nil {
+		l.first = i.next
+	} else {
 		i.prev.next = i.next
 	}
 
-	if i.next != nil {
-		i.next.prev = i.prev
-	}
-
-	if l.first == i && l.last == i {
-		l.first, l.last = nil, nil
-	} else if l.first == i {
-		l.first = i.next
-	} else if l.last == i {
+	if i.next == nil {
 		l.last = i.prev
+	} else {
+		i.next.prev = i.prev
 	}
 
-	return l
-}
-
-func connect(left, right listRange) {
-	if left.empty() || right.empty() {
-		return
-	}
-
-	if left.last.next == right.first {
-		return
-	}
-
-	if left.last.next != nil {
-		left.last.next.prev = right.last
-		right.last.next = left.last.next
-	}
-
-	if right.first.prev != nil {
-		right.first.prev.next = left.first
-		left.first.prev = right.first.prev
-	}
-
-	left.last.next = right.first
-	right.first.prev = left.last
+	i.prev, i.next = nil, nil
 }
@@ -1,6 +1,12 @@
 package treelock
 
-import "sync"
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 type lockType int
 
@@ -9,108 +15,889 @@ const (
 	writeLock
 	treeReadLock
 	treeWriteLock
+	intentReadLock
+	intentWriteLock
+	treeReadIntentWriteLock
+	childrenReadLock
+	childrenWriteLock
+	updateLock
+	treeUpdateLock
+	rangeReadLock
+	rangeWriteLock
+	semaphoreLock
+	treeSemaphoreLock
 )
 
+// unlimitedDepth is used for the locks whose subtree, if any, includes
+// all the descendants of the locked node.
+const unlimitedDepth = -1
+
 type operation struct {
-	typ       lockType
-	path      []string
-	item      *item
+	// gen is incremented when a released operation is recycled. It is
+	// accessed atomically, and it is the first field for the 64-bit
+	// alignment on 32-bit platforms.
+	gen uint64
+
+	id       uint64
+	owner    *Owner
+	typ      lockType
+	depth    int
+	excluded [][]string
+	from, to string
+	limit    int
+
+	// escalation is set for the node locks of owners, when the
+	// escalation of locks is enabled. The absorbed operations are
+	// covered by the tree lock of the escalation. treeOf is set for
+	// the tree lock of an escalation.
+	escalation *escalation
+	absorbed   bool
+	treeOf     *escalation
+
+	// global operations are on the root node or on paths starting with
+	// a wildcard, the rest belong to a shard, and they are anchored to
+	// the node of the longest prefix of their path without wildcards
+	global bool
+	shard  *shard
+
+	// fast read locks of a reader biased L are only registered in a
+	// bucket, until a revocation of the bias moves them into the tree
+	bucket          *readerBucket
+	fast            bool
+	bucketIndex     int
+	excludesReaders bool
+
+	// nodes are the nodes where the operation is registered, from the
+	// root of its shard to the node where it is anchored, and items are
+	// its entries in the lists of these nodes
+	path  []string
+	nodes []*node
+	items []item
+
+	// mx protects the blocking state of the operation, that is changed
+	// by other operations, too. The blocking relations are registered
+	// while holding the latch of the node where the other operation was
+	// found, so that the other operation can't be released meanwhile.
+	// linked is set when the operation had any blocking relations, and
+	// then it is not recycled, because the other operations may still
+	// reference it.
+	mx        sync.Mutex
 	blockedBy sync.WaitGroup
+	waiting   int
 	blocking  []*operation
+	blockers  []*operation
+	linked    bool
+	released  bool
+	granted   time.Time
 }
 
 // L instances provide read/write locking for tree structures with
 // nodes referenced by their path.
 type L struct {
-	tree *node
-	mx   sync.Mutex
-}
-
-func blockedByOnPath(o *operation, nodePath []*node) []*operation {
-	var ops []*operation
-	for _, n := range nodePath {
-		rangeOver(n.operations, func(no *operation) {
-			if no.typ == treeWriteLock ||
-				no.typ == treeReadLock &&
-					(o.typ == treeWriteLock || o.typ == writeLock) {
-				ops = append(ops, no)
-			}
-		})
+	// lastID is accessed atomically, and it is the first field for the
+	// 64-bit alignment on 32-bit platforms.
+	lastID uint64
+
+	// Audit, when set, receives a JSON line for every grant and release
+	// of a lock. The writes are serialized, and they happen while
+	// holding the internal locks of L. Write errors are ignored,
+	// therefore the writer should be fast and handle failures on its
+	// own, e.g. by buffering.
+	Audit io.Writer
+
+	// Modes, when set, defines custom lock modes, that can be acquired
+	// with the Lock method, instead of the built-in lock types. When
+	// custom modes are used, the methods acquiring the built-in lock
+	// types, e.g. ReadNode, must not be called.
+	Modes []Mode
+
+	// Compatible defines which custom modes can be held at the same
+	// time by different operations on the same nodes, where
+	// Compatible[i][j] refers to Modes[i] and Modes[j]. Two modes are
+	// considered compatible only if both Compatible[i][j] and
+	// Compatible[j][i] are true. It must be an N x N matrix, where N is
+	// the number of the custom modes.
+	Compatible [][]bool
+
+	// Wildcard, when set, is a path segment that matches any segment.
+	// E.g. with a wildcard of "*", a lock on the path "users", "*",
+	// "settings" conflicts with the locks on the settings of every
+	// user, but not with the locks on the other nodes of the users.
+	// The wildcard can be used in the path of any lock type, and a
+	// segment equal to it always means the wildcard.
+	Wildcard string
+
+	// EscalationThreshold, when set, enables the escalation of node
+	// locks acquired through an Owner. When an owner holds more than
+	// EscalationThreshold ReadNode or WriteNode locks on the children
+	// of the same node, other than the root, the locks are replaced
+	// by a single ReadTree or WriteTree lock of the owner on that node,
+	// and the subsequent node locks of the owner on the children are
+	// satisfied by the tree lock, too. The tree lock is released when
+	// all the node locks that it replaced were released. The escalation
+	// happens only when the tree lock can be granted without waiting,
+	// otherwise it is retried with the next node lock of the owner on
+	// the same children, this way it never blocks the owner.
+	EscalationThreshold int
+
+	// ReaderBias, when set, makes ReadNode cheaper for read-mostly
+	// trees. While no operations are held or waiting that may conflict
+	// with a read lock, ReadNode only registers the lock, without
+	// inserting it into the tree. The first such operation revokes the
+	// bias, moves the registered read locks into the tree, and the
+	// bias is enabled again some time after all these operations were
+	// released. The registered read locks are not listed by Grants, and
+	// the bias is not used for the locks acquired through an Owner, or
+	// when Audit or custom modes are set.
+	ReaderBias bool
+
+	// MaxPathDepth, when set, limits the number of the segments in the
+	// paths of the locks. The lock methods panic with ErrPathTooDeep
+	// when it is exceeded, before allocating anything for the path,
+	// while the methods of Checked return it. CheckPath can be used to
+	// validate the paths beforehand. The methods taking the string form
+	// of a path enforce it while parsing, counting also the segments
+	// that are dropped later by "..".
+	MaxPathDepth int
+
+	// MaxSegmentLength, when set, limits the length of the segments in
+	// the paths of the locks. The lock methods panic with
+	// ErrSegmentTooLong when it is exceeded, while the methods of
+	// Checked return it. The methods taking the string form of a path
+	// enforce it while parsing.
+	MaxSegmentLength int
+
+	// Canonical, when set, maps the path segments to their canonical
+	// form, before they are used to identify the nodes, so that the
+	// segments that it maps to the same string refer to the same node.
+	// E.g. with strings.ToLower, the locks on "Docs" and "docs"
+	// conflict. It must be safe for concurrent use. The wildcard
+	// segments are not mapped, the range keys are, and the order of a
+	// range is the order of the mapped keys. The path limits apply to
+	// the segments before the mapping, while Grants lists the mapped
+	// paths.
+	Canonical func(string) string
+
+	// PathSyntax defines how the string form of the paths is parsed by
+	// ParsePath and by the lock methods accepting the string form, e.g.
+	// WriteNodePath.
+	PathSyntax PathSyntax
+
+	modes  *modeSet
+	bias   *readerBias
+	ready  uint32
+	tree   *node
+	shards [shardCount]shard
+
+	// globals counts the global operations in the tree. It is accessed
+	// atomically.
+	globals int32
+
+	mx      sync.Mutex
+	auditMx sync.Mutex
+}
+
+func (o *operation) skip(no *operation) bool {
+	return o.owner != nil && no.owner == o.owner
+}
+
+// conflicts appends the operations in a list of a node that conflict
+// with the operation.
+func conflicts(m *modeSet, o *operation, l list, found []*operation) []*operation {
+	for i := l.first; i != nil; i = i.next {
+		if no := i.operation; !o.skip(no) && m.conflict(no, o) {
+			found = append(found, no)
+		}
 	}
 
-	return ops
+	return found
 }
 
-func blockedByOnNode(o *operation, n *node) []*operation {
-	var ops []*operation
-	rangeOver(n.operations, func(no *operation) {
-		if no.typ == writeLock ||
-			no.typ == treeWriteLock ||
-			o.typ == writeLock ||
-			o.typ == treeWriteLock {
-			ops = append(ops, no)
+// block registers the operations that the current one needs to wait
+// for. It expects the latch of the node where the blocking operations
+// were found, so that they can't be removed meanwhile. When the owner of
+// the operation already has other operations in the tree, the operation
+// waits only for the conflicting locks that were granted, while the
+// conflicting operations that are still waiting will wait for this one
+// instead. This prevents deadlocks when an owner converts or extends
+// its locks. When try is set, and there is a conflicting granted
+// operation, it returns false.
+func (l *L) block(o *operation, found []*operation, holding, try bool) bool {
+	if len(found) == 0 {
+		return true
+	}
+
+	if !holding {
+		for _, b := range reduceBlocking(found) {
+			wait(o, b)
 		}
-	})
 
-	return ops
+		return true
+	}
+
+	for _, b := range found {
+		if !yield(o, b, try) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// link makes an operation wait for another one. It expects the mutex
+// of the blocking operation.
+func link(o, b *operation) {
+	b.blocking = append(b.blocking, o)
+	b.linked = true
+	o.mx.Lock()
+	o.waiting++
+	o.blockers = append(o.blockers, b)
+	o.linked = true
+	o.mx.Unlock()
+	o.blockedBy.Add(1)
+}
+
+// wait makes an operation wait for another one, unless the other one
+// was already released.
+func wait(o, b *operation) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if !b.released {
+		link(o, b)
+	}
 }
 
-func blockedByOnSubtree(o *operation, n *node) []*operation {
-	var ops []*operation
-	rangeOver(n.subtreeOperations, func(no *operation) {
-		if o.typ == treeWriteLock ||
-			no.typ == treeWriteLock ||
-			no.typ == writeLock {
-			ops = append(ops, no)
+// yield makes an operation of an owner holding other operations wait
+// for a conflicting operation, if it was granted, or otherwise makes the
+// conflicting operation wait for this one.
+func yield(o, b *operation, try bool) bool {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.released {
+		return true
+	}
+
+	if b.waiting == 0 {
+		if try {
+			return false
 		}
-	})
 
-	return ops
+		link(o, b)
+		return true
+	}
+
+	b.waiting++
+	b.blockedBy.Add(1)
+	b.blockers = append(b.blockers, o)
+	b.linked = true
+	o.mx.Lock()
+	o.blocking = append(o.blocking, b)
+	o.linked = true
+	o.mx.Unlock()
+	return true
 }
 
-func initBlocking(nodePath []*node, o *operation) {
-	var blockedBy []*operation
-	n, np := nodePath[len(nodePath)-1], nodePath[:len(nodePath)-1]
-	blockedBy = append(blockedBy, blockedByOnPath(o, np)...)
-	blockedBy = append(blockedBy, blockedByOnNode(o, n)...)
-	if o.typ == treeReadLock || o.typ == treeWriteLock {
-		blockedBy = append(blockedBy, blockedByOnSubtree(o, n)...)
+// reduceBlocking drops those operations from the blocking ones, that
+// the operation waits for anyway, because they block one of the
+// others, directly or indirectly. This keeps the size of the blocking
+// graph linear, when e.g. readers and writers alternate on a node. The
+// blockers of the escalated tree locks are not visited, because a tree
+// lock may be released without ever being granted.
+func reduceBlocking(blockedBy []*operation) []*operation {
+	if len(blockedBy) < 2 {
+		return blockedBy
 	}
 
-	o.blockedBy.Add(len(blockedBy))
+	sort.Slice(blockedBy, func(i, j int) bool {
+		return blockedBy[i].id > blockedBy[j].id
+	})
+
+	covered := make(map[*operation]bool)
+	reduced := blockedBy[:0]
+	var visit []*operation
 	for _, b := range blockedBy {
-		b.blocking = append(b.blocking, o)
+		if covered[b] {
+			continue
+		}
+
+		reduced = append(reduced, b)
+		visit = append(visit, b)
+		for len(visit) > 0 {
+			v := visit[len(visit)-1]
+			visit = visit[:len(visit)-1]
+			if v.treeOf != nil {
+				continue
+			}
+
+			v.mx.Lock()
+			for _, vb := range v.blockers {
+				if !covered[vb] {
+					covered[vb] = true
+					visit = append(visit, vb)
+				}
+			}
+
+			v.mx.Unlock()
+		}
 	}
+
+	return reduced
 }
 
-func (l *L) acquire(typ lockType, path []string) func() {
-	o := &operation{
-		typ:  typ,
-		path: path,
+// operationPool holds the released operations, to be reused together
+// with the buffers of their path and node path.
+var operationPool = sync.Pool{New: func() interface{} { return &operation{} }}
+
+// newOperation takes an operation from the pool. It copies the path,
+// so that the variadic arguments of the lock methods don't escape.
+func (l *L) newOperation(owner *Owner, typ lockType, path []string) *operation {
+	o := operationPool.Get().(*operation)
+	o.owner = owner
+	o.typ = typ
+	o.depth = unlimitedDepth
+	o.path = append(o.path[:0], path...)
+	l.canonicalize(o.path)
+	return o
+}
+
+// canonicalize applies the Canonical function of L to the segments of
+// a path, except for the wildcards, in place.
+func (l *L) canonicalize(path []string) {
+	if l.Canonical == nil {
+		return
+	}
+
+	for i, s := range path {
+		if l.Wildcard == "" || s != l.Wildcard {
+			path[i] = l.Canonical(s)
+		}
+	}
+}
+
+// canonicalPath returns a canonical copy of a path, when the Canonical
+// function of L is set.
+func (l *L) canonicalPath(path []string) []string {
+	if l.Canonical == nil {
+		return path
+	}
+
+	path = append([]string(nil), path...)
+	l.canonicalize(path)
+	return path
+}
+
+// recycle puts a released operation back to the pool. Only those
+// operations are recycled that were released by their holder, and that
+// had no blocking relations, because the revoked and the escalated
+// operations, and the ones that other operations waited for or were
+// waited by, may still be referenced.
+func recycle(o *operation) {
+	gen := atomic.LoadUint64(&o.gen)
+
+	// the references to the other operations and to the nodes are
+	// cleared, to not keep them reachable from the pool
+	for i := range o.blocking {
+		o.blocking[i] = nil
+	}
+
+	for i := range o.nodes {
+		o.nodes[i] = nil
+	}
+
+	for i := range o.items {
+		o.items[i] = item{}
+	}
+
+	path, nodes, items, blocking := o.path[:0], o.nodes[:0], o.items[:0], o.blocking[:0]
+	*o = operation{}
+	o.path, o.nodes, o.items, o.blocking = path, nodes, items, blocking
+	atomic.StoreUint64(&o.gen, gen+1)
+	operationPool.Put(o)
+}
+
+func (l *L) acquire(owner *Owner, custom bool, typ lockType, path []string) (func(), error) {
+	if err := l.CheckPath(path...); err != nil {
+		return nil, err
+	}
+
+	return l.acquireOperation(custom, l.newOperation(owner, typ, path)), nil
+}
+
+func (l *L) acquireDepth(owner *Owner, typ lockType, depth int, path []string) (func(), error) {
+	if depth < 0 {
+		panic("treelock: negative depth")
+	}
+
+	if err := l.CheckPath(path...); err != nil {
+		return nil, err
+	}
+
+	o := l.newOperation(owner, typ, path)
+	o.depth = depth
+	return l.acquireOperation(false, o), nil
+}
+
+func (l *L) acquireExcluding(owner *Owner, typ lockType, path []string, excluded [][]string) (func(), error) {
+	for _, e := range excluded {
+		if len(e) == 0 {
+			panic("treelock: excluding the locked node")
+		}
+	}
+
+	if err := l.checkExcluded(path, excluded); err != nil {
+		return nil, err
+	}
+
+	o := l.newOperation(owner, typ, path)
+
+	// the excluded paths are copied, like the path, so that the caller
+	// can't change them while the lock is held
+	o.excluded = make([][]string, len(excluded))
+	for i, e := range excluded {
+		o.excluded[i] = append([]string(nil), e...)
+		l.canonicalize(o.excluded[i])
+	}
+
+	return l.acquireOperation(false, o), nil
+}
+
+func (l *L) acquireRange(owner *Owner, typ lockType, from, to string, path []string) (func(), error) {
+	if err := l.checkRange(path, from, to); err != nil {
+		return nil, err
+	}
+
+	if l.Canonical != nil {
+		from, to = l.Canonical(from), l.Canonical(to)
+	}
+
+	if from > to {
+		panic("treelock: the start of a range is after its end")
+	}
+
+	o := l.newOperation(owner, typ, path)
+	o.from, o.to = from, to
+	return l.acquireOperation(false, o), nil
+}
+
+func (l *L) acquireCounted(owner *Owner, typ lockType, limit int, path []string) (func(), error) {
+	if limit < 1 {
+		panic("treelock: the limit of a counted lock must be positive")
+	}
+
+	if err := l.CheckPath(path...); err != nil {
+		return nil, err
+	}
+
+	o := l.newOperation(owner, typ, path)
+	o.limit = limit
+	return l.acquireOperation(false, o), nil
+}
+
+func (l *L) init() {
+	if atomic.LoadUint32(&l.ready) == 1 {
+		return
 	}
 
 	l.mx.Lock()
-	if l.tree == nil {
-		l.tree = &node{}
+	defer l.mx.Unlock()
+	if l.modes != nil {
+		return
+	}
+
+	if len(l.Modes) > 0 {
+		l.modes = customModes(l.Modes, l.Compatible)
+	} else {
+		m := builtinModes
+		l.modes = &m
+	}
+
+	l.modes.wildcard = l.Wildcard
+	l.tree = &node{}
+	if l.ReaderBias && !l.modes.custom {
+		l.bias = newReaderBias()
+	}
+
+	atomic.StoreUint32(&l.ready, 1)
+}
+
+func (l *L) acquireOperation(custom bool, o *operation) func() {
+	l.init()
+	if custom != l.modes.custom {
+		panic("treelock: built-in and custom lock modes mixed")
+	}
+
+	if o.typ < 0 || int(o.typ) >= len(l.modes.modes) {
+		panic("treelock: invalid lock mode")
+	}
+
+	gen := atomic.LoadUint64(&o.gen)
+	if l.fastRead(o) {
+		if l.bias.read(o) {
+			return func() {
+				l.release(o, gen)
+			}
+		}
+
+		l.bias.enable()
+	} else if l.bias != nil && l.modes.excludesReaders(o.typ) {
+		l.revokeBias(o)
+	}
+
+	l.setShard(o)
+	if l.absorb(o) {
+		if l.bias != nil {
+			// the tree lock is counted instead
+			l.bias.releaseWriter(o)
+		}
+
+		return func() {
+			l.release(o, gen)
+		}
+	}
+
+	l.insertOperation(o, false)
+	l.unblock(o, nil)
+	if o.escalation != nil {
+		l.escalate(o.escalation)
 	}
 
-	np := nodePath(l.tree, o.path)
-	initBlocking(np, o)
-	insert(np, o)
-	l.mx.Unlock()
 	o.blockedBy.Wait()
 	return func() {
-		l.release(o)
+		l.release(o, gen)
 	}
 }
 
-func (l *L) release(o *operation) {
-	l.mx.Lock()
-	defer l.mx.Unlock()
-	np := nodePath(l.tree, o.path)
-	remove(np, o)
-	for _, b := range o.blocking {
-		b.blockedBy.Done()
+// insertOperation inserts the operation into the tree, and registers
+// the operations that it needs to wait for. The operation is inserted
+// with an extra blocker, that keeps it waiting until the insertion is
+// complete, and that needs to be removed by the caller with unblock.
+// When try is set, it returns false if the operation can't be granted
+// immediately, and then the caller needs to release the operation.
+func (l *L) insertOperation(o *operation, try bool) bool {
+	o.id = atomic.AddUint64(&l.lastID, 1)
+	holding := o.owner != nil && o.owner.holding()
+	o.waiting = 1
+	o.blockedBy.Add(1)
+	if o.owner != nil {
+		o.owner.count(1)
+	}
+
+	n := l.anchor(o.path) + 1
+	if cap(o.items) < n {
+		o.items = make([]item, n)
+	}
+
+	o.items = o.items[:n]
+	if o.global {
+		return l.insertGlobal(o, holding, try)
+	}
+
+	return l.insertShard(o, holding, try)
+}
+
+// insertGlobal inserts a global operation into the root node of L. It
+// takes the latch of every shard, because it may conflict with any
+// operation.
+func (l *L) insertGlobal(o *operation, holding, try bool) bool {
+	m := l.modes
+	l.lockShards()
+	found := conflicts(m, o, l.tree.operations, nil)
+	if m.checkSubtree(o) || len(o.path) > 0 {
+		for i := range l.shards {
+			found = conflicts(m, o, l.shards[i].root.subtreeOperations, found)
+		}
+	}
+
+	ok := l.block(o, found, holding, try)
+	o.nodes = append(o.nodes[:0], l.tree)
+	o.items[0].operation = o
+	if o.limit > 0 {
+		takeSlot(l.tree, o)
+	}
+
+	l.tree.operations.push(&o.items[0])
+	atomic.AddInt32(&l.globals, 1)
+	l.unlockShards()
+	return ok
+}
+
+// insertShard inserts an operation of a shard, descending from the root
+// of the shard to the node where the operation is anchored, taking the
+// latches hand over hand. On each node, it checks the operations
+// anchored there, and, on the anchor node, the operations anchored in
+// the subtree, too. Since the operations can't overtake each other on
+// the common part of their paths, an operation always finds the
+// conflicting operations inserted before it.
+func (l *L) insertShard(o *operation, holding, try bool) bool {
+	m := l.modes
+	k := len(o.items) - 1
+	n := &o.shard.root
+	n.mx.Lock()
+	ok := true
+	var found []*operation
+	if atomic.LoadInt32(&l.globals) > 0 {
+		l.tree.mx.Lock()
+		found = conflicts(m, o, l.tree.operations, found)
+		ok = l.block(o, found, holding, try)
+		l.tree.mx.Unlock()
+	}
+
+	o.nodes = append(o.nodes[:0], n)
+	for i := 0; ; i++ {
+		found = found[:0]
+		if i > 0 {
+			found = conflicts(m, o, n.operations, found)
+		}
+
+		if i == k && (m.checkSubtree(o) || k < len(o.path)) {
+			found = conflicts(m, o, n.subtreeOperations, found)
+		}
+
+		if ok {
+			ok = l.block(o, found, holding, try)
+		}
+
+		it := &o.items[i]
+		it.operation = o
+		if i == k {
+			if o.limit > 0 {
+				takeSlot(n, o)
+			}
+
+			n.operations.push(it)
+			n.mx.Unlock()
+			return ok
+		}
+
+		n.subtreeOperations.push(it)
+		if i == k-1 && l.escalates(o) {
+			l.track(n, o)
+		}
+
+		c := n.children.get(o.path[i])
+		if c == nil {
+			l.insertPath(n, o, i+1)
+			return ok
+		}
+
+		c.mx.Lock()
+		n.mx.Unlock()
+		n = c
+		o.nodes = append(o.nodes, n)
+	}
+}
+
+// insertPath inserts an operation below a node, when the rest of its
+// path doesn't exist. The missing nodes are created and connected to
+// each other first, and only then to the node, this way they are not
+// reachable by other operations before the operation was inserted, and
+// they don't need to be latched. It expects the latch of the node, and
+// releases it.
+func (l *L) insertPath(parent *node, o *operation, from int) {
+	k := len(o.items) - 1
+	var (
+		sh       *shard
+		n, first *node
+		firstKey string
+	)
+
+	for i := from; i <= k; i++ {
+		key := o.path[i-1]
+		if next := &l.shards[shardIndex(key)]; next != sh {
+			if sh != nil {
+				sh.stringsMx.Unlock()
+			}
+
+			sh = next
+			sh.stringsMx.Lock()
+		}
+
+		c := nodePool.Get().(*node)
+		key = sh.strings.intern(key)
+		if n == nil {
+			first, firstKey = c, key
+		} else {
+			n.children.add(key, c)
+		}
+
+		n = c
+		o.nodes = append(o.nodes, n)
+		it := &o.items[i]
+		it.operation = o
+		if i == k {
+			n.operations.push(it)
+		} else {
+			n.subtreeOperations.push(it)
+		}
+	}
+
+	sh.stringsMx.Unlock()
+	if o.limit > 0 {
+		takeSlot(n, o)
+	}
+
+	if k-1 >= from && l.escalates(o) {
+		l.track(o.nodes[k-1], o)
+	}
+
+	parent.children.add(firstKey, first)
+	parent.mx.Unlock()
+}
+
+// grant is called when an operation doesn't wait for any other
+// operations anymore. It expects the mutex of the operation.
+func (l *L) grant(o *operation) {
+	o.blockers = nil
+	if l.Audit != nil {
+		o.granted = time.Now()
+		l.audit(auditGrant, o)
+	}
+}
+
+// tryGrant removes the extra blocker of an inserted operation, if it
+// doesn't wait for any other operations. Otherwise it returns false.
+func (l *L) tryGrant(o *operation) bool {
+	o.mx.Lock()
+	if o.waiting > 1 {
+		o.mx.Unlock()
+		return false
+	}
+
+	o.waiting = 0
+	l.grant(o)
+	o.mx.Unlock()
+	o.blockedBy.Done()
+	return true
+}
+
+// claim marks an operation released, unless it was already released,
+// or, when grantedOnly is set, it was not yet granted. Only the caller
+// that claimed an operation may detach it.
+func claim(o *operation, grantedOnly bool) bool {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+	if o.released || grantedOnly && o.waiting > 0 {
+		return false
+	}
+
+	o.released = true
+	return true
+}
+
+// granted tells whether an operation was granted and not yet released.
+func granted(o *operation) bool {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+	return o.waiting == 0 && !o.released
+}
+
+func (l *L) releaseOperation(o *operation, event string) bool {
+	if !claim(o, false) {
+		return false
+	}
+
+	l.detach(o, event)
+	return true
+}
+
+// detach removes a claimed operation from the tree, and lets the
+// operations waiting for it proceed.
+func (l *L) detach(o *operation, event string) {
+	if o.owner != nil {
+		o.owner.count(-1)
+	}
+
+	if l.bias != nil {
+		l.bias.releaseWriter(o)
+	}
+
+	if e := o.escalation; e != nil {
+		e.untrack(o)
+		l.finishEscalation(e)
+	}
+
+	if e := o.treeOf; e != nil {
+		// when the tree lock was revoked, the subsequent node locks
+		// of the owner are not absorbed anymore, and the escalation is
+		// detached from the node, because the node may be removed and
+		// reused before the absorbed node locks are released
+		e.detachTree(o)
+	}
+
+	if event != "" && l.Audit != nil {
+		l.audit(event, o)
+	}
+
+	l.removeOperation(o)
+	o.mx.Lock()
+	blocking := o.blocking
+	o.mx.Unlock()
+	for _, b := range blocking {
+		l.unblock(b, o)
+	}
+}
+
+// unblock is called when an operation blocking the current one, or, in
+// case of counted locks, the lack of free slots, or the insertion of
+// the operation, doesn't block it anymore. The released blocking
+// operation is removed from the blockers.
+func (l *L) unblock(o, by *operation) {
+	o.mx.Lock()
+	if by != nil {
+		for i, b := range o.blockers {
+			if b == by {
+				o.blockers = append(o.blockers[:i], o.blockers[i+1:]...)
+				break
+			}
+		}
+	}
+
+	o.waiting--
+	if o.waiting == 0 {
+		l.grant(o)
+	}
+
+	o.mx.Unlock()
+	o.blockedBy.Done()
+}
+
+func (l *L) release(o *operation, gen uint64) {
+	if atomic.LoadUint64(&o.gen) != gen {
+		return
+	}
+
+	if o.bucket != nil && l.bias.release(o) {
+		recycle(o)
+		return
+	}
+
+	var claimed bool
+	if e := o.escalation; e != nil {
+		e.owner.mx.Lock()
+		if o.absorbed {
+			o.absorbed = false
+			e.refs--
+			e.owner.mx.Unlock()
+			l.finishEscalation(e)
+			return
+		}
+
+		claimed = claim(o, false)
+		e.owner.mx.Unlock()
+	} else {
+		claimed = claim(o, false)
+	}
+
+	if !claimed {
+		return
+	}
+
+	l.detach(o, auditRelease)
+	o.mx.Lock()
+	linked := o.linked
+	o.mx.Unlock()
+	if !linked {
+		recycle(o)
 	}
 }
 
@@ -124,7 +911,7 @@ func (l *L) release(o *operation) {
 // on the path to the current node.
 //
 func (l *L) ReadNode(path ...string) func() {
-	return l.acquire(readLock, path)
+	return must(l.acquire(nil, false, readLock, path))
 }
 
 // WriteNode acquires a write lock for an individual node represented by
@@ -137,7 +924,7 @@ func (l *L) ReadNode(path ...string) func() {
 // write tree lock on the path to the current node.
 //
 func (l *L) WriteNode(path ...string) func() {
-	return l.acquire(writeLock, path)
+	return must(l.acquire(nil, false, writeLock, path))
 }
 
 // ReadTree acquires a read lock for the subtree starting from the node
@@ -151,7 +938,7 @@ func (l *L) WriteNode(path ...string) func() {
 // node, or a write tree lock on the path to the current node.
 //
 func (l *L) ReadTree(path ...string) func() {
-	return l.acquire(treeReadLock, path)
+	return must(l.acquire(nil, false, treeReadLock, path))
 }
 
 // WriteTree acquires a write lock for the subtree starting from the
@@ -165,5 +952,240 @@ func (l *L) ReadTree(path ...string) func() {
 // or a read or write tree lock on the path to the current node.
 //
 func (l *L) WriteTree(path ...string) func() {
-	return l.acquire(treeWriteLock, path)
+	return must(l.acquire(nil, false, treeWriteLock, path))
+}
+
+// ReadTreeDepth acquires a read lock for the node represented by the
+// path, and for its descendants up to the specified depth, e.g. 1 for
+// the node and its direct children. Otherwise, it works the same way as
+// ReadTree, and the descendants deeper than the specified depth are
+// not locked.
+//
+func (l *L) ReadTreeDepth(depth int, path ...string) func() {
+	return must(l.acquireDepth(nil, treeReadLock, depth, path))
+}
+
+// WriteTreeDepth acquires a write lock for the node represented by the
+// path, and for its descendants up to the specified depth, e.g. 1 for
+// the node and its direct children. Otherwise, it works the same way as
+// WriteTree, and the descendants deeper than the specified depth are
+// not locked.
+//
+func (l *L) WriteTreeDepth(depth int, path ...string) func() {
+	return must(l.acquireDepth(nil, treeWriteLock, depth, path))
+}
+
+// ReadTreeExcluding acquires a read lock for the subtree starting from
+// the node represented by the path, excluding the subtrees of the
+// specified descendants. The excluded paths are relative to the locked
+// node, e.g. []string{"cache"} excludes the child called cache and its
+// subtree. Otherwise, it works the same way as ReadTree, and the
+// excluded subtrees are not locked.
+//
+func (l *L) ReadTreeExcluding(path []string, excluded ...[]string) func() {
+	return must(l.acquireExcluding(nil, treeReadLock, path, excluded))
+}
+
+// WriteTreeExcluding acquires a write lock for the subtree starting
+// from the node represented by the path, excluding the subtrees of the
+// specified descendants. The excluded paths are relative to the locked
+// node, e.g. []string{"cache"} excludes the child called cache and its
+// subtree. Otherwise, it works the same way as WriteTree, and the
+// excluded subtrees are not locked.
+//
+func (l *L) WriteTreeExcluding(path []string, excluded ...[]string) func() {
+	return must(l.acquireExcluding(nil, treeWriteLock, path, excluded))
+}
+
+// ReadRange acquires a read lock for the children of the node
+// represented by the path, whose key, the last segment of their path,
+// is between from and to, inclusive, in lexicographic order. It panics
+// when from is greater than to. The children in the range don't need to
+// exist. It blocks until no preceding operations hold a lock preventing
+// the read of the children in the range. The returned function must be
+// called to release the lock when the operation finished.
+//
+// While holding the lock, subsequent operations will be blocked if they
+// try to acquire a write lock or a write tree lock on any child in the
+// range, a write range lock with an overlapping range, a write children
+// lock on the current node, or a write tree lock on the current node or
+// on the path to it. This way, the lock protects range scans against
+// concurrently created children.
+//
+func (l *L) ReadRange(from, to string, path ...string) func() {
+	return must(l.acquireRange(nil, rangeReadLock, from, to, path))
+}
+
+// WriteRange acquires a write lock for the children of the node
+// represented by the path, whose key, the last segment of their path,
+// is between from and to, inclusive, in lexicographic order. It panics
+// when from is greater than to. The children in the range don't need to
+// exist. It blocks until no preceding operations hold any lock on the
+// children in the range. The returned function must be called to
+// release the lock when the operation finished.
+//
+// While holding the lock, subsequent operations will be blocked if they
+// try to acquire any lock on the children in the range, a range lock
+// with an overlapping range, a children lock on the current node, or a
+// read or write tree lock on the current node or on the path to it.
+//
+func (l *L) WriteRange(from, to string, path ...string) func() {
+	return must(l.acquireRange(nil, rangeWriteLock, from, to, path))
+}
+
+// SemaphoreNode acquires a counted lock for an individual node
+// represented by its path, allowing up to limit operations to hold it
+// concurrently. It blocks until no preceding operations hold a write
+// lock on the node, or a write tree lock on the path to it, and less
+// than limit operations hold a counted lock on the node. The returned
+// function must be called to release the lock when the operation
+// finished.
+//
+// While holding the lock, subsequent operations will be blocked if they
+// try to acquire a write lock on the current node, or a write tree lock
+// on the path to the current node, or when already limit operations
+// hold counted locks on the node. The counted locks don't block read
+// locks.
+//
+func (l *L) SemaphoreNode(limit int, path ...string) func() {
+	return must(l.acquireCounted(nil, semaphoreLock, limit, path))
+}
+
+// SemaphoreTree acquires a counted lock for the subtree starting from
+// the node represented by the path, allowing up to limit operations to
+// hold it concurrently. It works the same way as SemaphoreNode, but it
+// blocks, and is blocked by, the write locks in the subtree, too. The
+// counted node and tree locks on the same node share the same slots.
+//
+func (l *L) SemaphoreTree(limit int, path ...string) func() {
+	return must(l.acquireCounted(nil, treeSemaphoreLock, limit, path))
+}
+
+// IntentRead acquires an intention lock on the node represented by the
+// path, declaring that the holder is going to read nodes in its
+// subtree. It blocks until no preceding operations hold a write tree
+// lock on the node or on the path to it. The returned function must be
+// called to release the lock when the operation finished.
+//
+// While holding the lock, subsequent operations will be blocked if they
+// try to acquire a write tree lock on the current node or on the path
+// to the current node. Locks on the nodes in the subtree are not
+// affected, those need to be acquired separately.
+//
+func (l *L) IntentRead(path ...string) func() {
+	return must(l.acquire(nil, false, intentReadLock, path))
+}
+
+// IntentWrite acquires an intention lock on the node represented by the
+// path, declaring that the holder is going to write nodes in its
+// subtree. It blocks until no preceding operations hold a read or write
+// tree lock on the node or on the path to it. The returned function
+// must be called to release the lock when the operation finished.
+//
+// While holding the lock, subsequent operations will be blocked if they
+// try to acquire a read or write tree lock on the current node or on
+// the path to the current node. Locks on the nodes in the subtree are
+// not affected, those need to be acquired separately.
+//
+func (l *L) IntentWrite(path ...string) func() {
+	return must(l.acquire(nil, false, intentWriteLock, path))
+}
+
+// ReadTreeIntentWrite acquires a read lock for the subtree starting
+// from the node represented by the path, combined with the intention
+// to write some of the nodes in the subtree. It blocks until no
+// preceding operations hold locks that prevent either. The returned
+// function must be called to release the lock when the operation
+// finished.
+//
+// While holding the lock, subsequent operations will be blocked if they
+// try to acquire a write lock in the subtree, including the current
+// node, or a read or write tree lock on the current node or on the path
+// to it. Read locks in the subtree are allowed to proceed.
+//
+// The writes in the subtree need to be locked separately, and since
+// the read lock of the subtree would block them, this lock is useful
+// only when acquired through an Owner, together with the write locks
+// in the subtree.
+//
+func (l *L) ReadTreeIntentWrite(path ...string) func() {
+	return must(l.acquire(nil, false, treeReadIntentWriteLock, path))
+}
+
+// Lock acquires a lock in one of the custom modes defined by the Modes
+// field, where the mode argument is the index of the mode. It blocks
+// until no preceding operations hold a lock in an incompatible mode on
+// any of the nodes that the requested mode applies to. The returned
+// function must be called to release the lock when the operation
+// finished.
+//
+// While holding the lock, subsequent operations will be blocked if they
+// try to acquire a lock in an incompatible mode, that applies to any of
+// the nodes that the current lock applies to. It panics when no custom
+// modes were defined.
+//
+func (l *L) Lock(mode int, path ...string) func() {
+	return must(l.acquire(nil, true, lockType(mode), path))
+}
+
+// ReadChildren acquires a read lock for the set of the children of the
+// node represented by the path, e.g. for listing a directory. It blocks
+// until no preceding operations hold a lock preventing the children
+// from being read. The returned function must be called to release the
+// lock when the operation finished.
+//
+// While holding the lock, subsequent operations will be blocked if they
+// try to acquire a write children lock on the current node, or a write
+// tree lock on the current node or on the path to it. The node itself
+// and its existing children are not locked.
+//
+func (l *L) ReadChildren(path ...string) func() {
+	return must(l.acquire(nil, false, childrenReadLock, path))
+}
+
+// WriteChildren acquires a write lock for the set of the children of
+// the node represented by the path, e.g. for creating or deleting a
+// file in a directory. It blocks until no preceding operations hold a
+// lock preventing changes to the set of children. The returned function
+// must be called to release the lock when the operation finished.
+//
+// While holding the lock, subsequent operations will be blocked if they
+// try to acquire a read or write children lock on the current node, or
+// a read or write tree lock on the current node or on the path to it.
+// Unlike with WriteTree, the node itself and the content of its
+// existing children can be read and written concurrently.
+//
+func (l *L) WriteChildren(path ...string) func() {
+	return must(l.acquire(nil, false, childrenWriteLock, path))
+}
+
+// UpdateNode acquires an update lock for an individual node represented
+// by its path, for operations that read the node and then may decide to
+// write it. It blocks until no preceding operations hold an update or
+// write lock on the node, or a write tree lock on the path to it. The
+// returned function must be called to release the lock when the
+// operation finished.
+//
+// While holding the lock, subsequent operations will be blocked if they
+// try to acquire an update or write lock on the current node, or an
+// update or write tree lock on the path to the current node. Read locks
+// are allowed to proceed.
+//
+// When acquired through an Owner, the update lock can be converted to
+// a write lock by acquiring WriteNode on the same node through the same
+// owner. Since only a single update lock can be held on a node, the
+// conversion cannot deadlock with another conversion. It waits only for
+// the read locks that were already granted.
+//
+func (l *L) UpdateNode(path ...string) func() {
+	return must(l.acquire(nil, false, updateLock, path))
+}
+
+// UpdateTree acquires an update lock for the subtree starting from the
+// node represented by the path. It works the same way as UpdateNode,
+// but it applies to every node in the subtree, and it can be converted
+// to a write lock of any node in the subtree, or to WriteTree.
+//
+func (l *L) UpdateTree(path ...string) func() {
+	return must(l.acquire(nil, false, treeUpdateLock, path))
 }
@@ -1,6 +1,7 @@
 package treelock
 
 import (
+	"strings"
 	"testing"
 	"time"
 )
@@ -866,3 +867,918 @@ func TestLockRace(t *testing.T) {
 	<-done1
 	<-done2
 }
+
+func TestLockIntention(t *testing.T) {
+	t.Run("intent read", func(t *testing.T) {
+		testRun(t, "intents", func(t *testing.T) {
+			l := new(L)
+			r1 := l.IntentRead("foo")
+			r2 := l.IntentRead("foo")
+			r3 := l.IntentWrite("foo")
+			r3()
+			r4 := l.ReadTreeIntentWrite("foo")
+			r4()
+			r2()
+			r1()
+		})
+
+		testRun(t, "node write", func(t *testing.T) {
+			l := new(L)
+			r1 := l.IntentRead("foo")
+			r2 := l.WriteNode("foo")
+			r3 := l.WriteNode("foo", "bar")
+			r3()
+			r2()
+			r1()
+		})
+
+		testRun(t, "write tree", func(t *testing.T) {
+			l := new(L)
+			r := l.IntentRead("foo")
+			testLocked(t, l, r, l.WriteTree, "foo")
+		})
+
+		testRun(t, "write tree on parent", func(t *testing.T) {
+			l := new(L)
+			r := l.IntentRead("foo", "bar")
+			testLocked(t, l, r, l.WriteTree, "foo")
+		})
+
+		testRun(t, "write tree in subtree", func(t *testing.T) {
+			l := new(L)
+			r1 := l.IntentRead("foo")
+			r2 := l.WriteTree("foo", "bar")
+			r2()
+			r1()
+		})
+	})
+
+	t.Run("intent write", func(t *testing.T) {
+		testRun(t, "read tree", func(t *testing.T) {
+			l := new(L)
+			r := l.IntentWrite("foo")
+			testLocked(t, l, r, l.ReadTree, "foo")
+		})
+
+		testRun(t, "read tree on parent", func(t *testing.T) {
+			l := new(L)
+			r := l.ReadTree("foo")
+			testLocked(t, l, r, l.IntentWrite, "foo", "bar")
+		})
+
+		testRun(t, "node read and write", func(t *testing.T) {
+			l := new(L)
+			r1 := l.IntentWrite("foo")
+			r2 := l.ReadNode("foo")
+			r3 := l.WriteNode("foo", "bar")
+			r4 := l.ReadTree("foo", "baz")
+			r4()
+			r3()
+			r2()
+			r1()
+		})
+
+		testRun(t, "read tree intent write", func(t *testing.T) {
+			l := new(L)
+			r := l.IntentWrite("foo")
+			testLocked(t, l, r, l.ReadTreeIntentWrite, "foo")
+		})
+	})
+
+	t.Run("read tree intent write", func(t *testing.T) {
+		testRun(t, "reads in subtree", func(t *testing.T) {
+			l := new(L)
+			r1 := l.ReadTreeIntentWrite("foo")
+			r2 := l.ReadNode("foo")
+			r3 := l.ReadNode("foo", "bar")
+			r4 := l.ReadTree("foo", "baz")
+			r4()
+			r3()
+			r2()
+			r1()
+		})
+
+		testRun(t, "write in subtree", func(t *testing.T) {
+			l := new(L)
+			r := l.ReadTreeIntentWrite("foo")
+			testLocked(t, l, r, l.WriteNode, "foo", "bar")
+		})
+
+		testRun(t, "read tree", func(t *testing.T) {
+			l := new(L)
+			r := l.ReadTreeIntentWrite("foo")
+			testLocked(t, l, r, l.ReadTree, "foo")
+		})
+
+		testRun(t, "read tree on parent", func(t *testing.T) {
+			l := new(L)
+			r := l.ReadTreeIntentWrite("foo", "bar")
+			testLocked(t, l, r, l.ReadTree, "foo")
+		})
+
+		testRun(t, "owner writes in subtree", func(t *testing.T) {
+			l := new(L)
+			o := l.Owner("foo")
+			r1 := o.ReadTreeIntentWrite("foo")
+			r2 := l.ReadNode("foo", "baz")
+			r3 := o.WriteNode("foo", "bar")
+			testLocked(t, l, r2, o.WriteNode, "foo", "baz")
+			r3()
+			r1()
+		})
+	})
+}
+
+func TestLockOwner(t *testing.T) {
+	testRun(t, "no self blocking", func(t *testing.T) {
+		l := new(L)
+		o := l.Owner("foo")
+		r1 := o.WriteTree("foo")
+		r2 := o.WriteNode("foo", "bar")
+		r3 := o.ReadNode("foo")
+		r3()
+		r2()
+		r1()
+	})
+
+	testRun(t, "others blocked", func(t *testing.T) {
+		l := new(L)
+		o := l.Owner("foo")
+		r := o.WriteNode("foo")
+		testLocked(t, l, r, l.Owner("bar").ReadNode, "foo")
+	})
+
+	testRun(t, "convert waits for readers", func(t *testing.T) {
+		l := new(L)
+		o := l.Owner("foo")
+		r1 := o.ReadNode("foo")
+		r2 := l.ReadNode("foo")
+		testLocked(t, l, r2, o.WriteNode, "foo")
+		r1()
+	})
+
+	testRun(t, "convert precedes waiting", func(t *testing.T) {
+		l := new(L)
+		o := l.Owner("foo")
+		r1 := o.ReadNode("foo")
+		waiting := make(chan struct{})
+		done := make(chan struct{})
+		converted := make(chan struct{})
+		go func() {
+			close(waiting)
+			l.WriteNode("foo")()
+			select {
+			case <-converted:
+			default:
+				t.Error("conversion did not take precedence")
+			}
+
+			close(done)
+		}()
+
+		<-waiting
+		time.Sleep(minDelay)
+		r2 := o.WriteNode("foo")
+		close(converted)
+		r2()
+		r1()
+		<-done
+	})
+}
+
+func TestLockChildren(t *testing.T) {
+	testRun(t, "read", func(t *testing.T) {
+		l := new(L)
+		r1 := l.ReadChildren("foo")
+		r2 := l.ReadChildren("foo")
+		r3 := l.ReadTree("foo")
+		r3()
+		r2()
+		r1()
+	})
+
+	testRun(t, "read and write", func(t *testing.T) {
+		l := new(L)
+		r := l.ReadChildren("foo")
+		testLocked(t, l, r, l.WriteChildren, "foo")
+	})
+
+	testRun(t, "write and read", func(t *testing.T) {
+		l := new(L)
+		r := l.WriteChildren("foo")
+		testLocked(t, l, r, l.ReadChildren, "foo")
+	})
+
+	testRun(t, "write and write", func(t *testing.T) {
+		l := new(L)
+		r := l.WriteChildren("foo")
+		testLocked(t, l, r, l.WriteChildren, "foo")
+	})
+
+	testRun(t, "write and node", func(t *testing.T) {
+		l := new(L)
+		r1 := l.WriteChildren("foo")
+		r2 := l.WriteNode("foo")
+		r3 := l.WriteNode("foo", "bar")
+		r4 := l.WriteChildren("foo", "bar")
+		r4()
+		r3()
+		r2()
+		r1()
+	})
+
+	testRun(t, "write and read tree", func(t *testing.T) {
+		l := new(L)
+		r := l.WriteChildren("foo")
+		testLocked(t, l, r, l.ReadTree, "foo")
+	})
+
+	testRun(t, "read and write tree", func(t *testing.T) {
+		l := new(L)
+		r := l.ReadChildren("foo")
+		testLocked(t, l, r, l.WriteTree, "foo")
+	})
+
+	testRun(t, "write and read tree on parent", func(t *testing.T) {
+		l := new(L)
+		r := l.WriteChildren("foo", "bar")
+		testLocked(t, l, r, l.ReadTree, "foo")
+	})
+
+	testRun(t, "write tree and read on child", func(t *testing.T) {
+		l := new(L)
+		r := l.WriteTree("foo")
+		testLocked(t, l, r, l.ReadChildren, "foo", "bar")
+	})
+}
+
+func TestLockUpdate(t *testing.T) {
+	testRun(t, "readers", func(t *testing.T) {
+		l := new(L)
+		r1 := l.ReadNode("foo")
+		r2 := l.UpdateNode("foo")
+		r3 := l.ReadNode("foo")
+		r4 := l.ReadTree()
+		r4()
+		r3()
+		r2()
+		r1()
+	})
+
+	testRun(t, "update", func(t *testing.T) {
+		l := new(L)
+		r := l.UpdateNode("foo")
+		testLocked(t, l, r, l.UpdateNode, "foo")
+	})
+
+	testRun(t, "write", func(t *testing.T) {
+		l := new(L)
+		r := l.UpdateNode("foo")
+		testLocked(t, l, r, l.WriteNode, "foo")
+	})
+
+	testRun(t, "update tree on parent", func(t *testing.T) {
+		l := new(L)
+		r := l.UpdateTree("foo")
+		testLocked(t, l, r, l.UpdateNode, "foo", "bar")
+	})
+
+	testRun(t, "intent write", func(t *testing.T) {
+		l := new(L)
+		r := l.UpdateTree("foo")
+		testLocked(t, l, r, l.IntentWrite, "foo")
+	})
+
+	testRun(t, "convert", func(t *testing.T) {
+		l := new(L)
+		o := l.Owner("foo")
+		r1 := o.UpdateNode("foo")
+		r2 := l.ReadNode("foo")
+		testLocked(t, l, r2, o.WriteNode, "foo")
+		r1()
+	})
+
+	testRun(t, "concurrent convert", func(t *testing.T) {
+		l := new(L)
+		convert := func(owner string) <-chan struct{} {
+			done := make(chan struct{})
+			go func() {
+				o := l.Owner(owner)
+				r1 := o.UpdateNode("foo")
+				time.Sleep(minDelay)
+				r2 := o.WriteNode("foo")
+				r2()
+				r1()
+				close(done)
+			}()
+
+			return done
+		}
+
+		done1 := convert("foo")
+		done2 := convert("bar")
+		<-done1
+		<-done2
+	})
+}
+
+func withCount(method func(int, ...string) func(), n int) func(...string) func() {
+	return func(path ...string) func() {
+		return method(n, path...)
+	}
+}
+
+func TestLockTreeDepth(t *testing.T) {
+	testRun(t, "within depth", func(t *testing.T) {
+		l := new(L)
+		r := l.WriteTreeDepth(1, "foo")
+		testLocked(t, l, r, l.ReadNode, "foo", "bar")
+	})
+
+	testRun(t, "node", func(t *testing.T) {
+		l := new(L)
+		r := l.WriteTreeDepth(1, "foo")
+		testLocked(t, l, r, l.ReadNode, "foo")
+	})
+
+	testRun(t, "beyond depth", func(t *testing.T) {
+		l := new(L)
+		r1 := l.WriteTreeDepth(1, "foo")
+		r2 := l.WriteNode("foo", "bar", "baz")
+		r3 := l.WriteTree("foo", "bar", "qux")
+		r3()
+		r2()
+		r1()
+	})
+
+	testRun(t, "children of last level", func(t *testing.T) {
+		l := new(L)
+		r1 := l.WriteTreeDepth(1, "foo")
+		r2 := l.WriteChildren("foo", "bar")
+		r2()
+		r1()
+	})
+
+	testRun(t, "children within depth", func(t *testing.T) {
+		l := new(L)
+		r := l.WriteTreeDepth(1, "foo")
+		testLocked(t, l, r, l.ReadChildren, "foo")
+	})
+
+	testRun(t, "subtree overlapping depth", func(t *testing.T) {
+		l := new(L)
+		r := l.WriteTreeDepth(2, "foo")
+		testLocked(t, l, r, l.ReadTree, "foo", "bar")
+	})
+
+	testRun(t, "subtree below depth", func(t *testing.T) {
+		l := new(L)
+		r1 := l.WriteTreeDepth(1, "foo")
+		r2 := l.ReadTree("foo", "bar", "baz")
+		r2()
+		r1()
+	})
+
+	testRun(t, "zero depth", func(t *testing.T) {
+		l := new(L)
+		r1 := l.WriteTreeDepth(0, "foo")
+		r2 := l.WriteNode("foo", "bar")
+		r3 := l.WriteTreeDepth(0, "foo", "baz")
+		r3()
+		r2()
+		r1()
+	})
+
+	testRun(t, "parent tree", func(t *testing.T) {
+		l := new(L)
+		r1 := l.ReadTreeDepth(1, "foo", "bar", "baz")
+		r2 := l.WriteTreeDepth(1, "foo")
+		r2()
+		r1()
+	})
+
+	testRun(t, "parent tree overlapping", func(t *testing.T) {
+		l := new(L)
+		r := l.ReadTreeDepth(1, "foo", "bar")
+		testLocked(t, l, r, withCount(l.WriteTreeDepth, 1), "foo")
+	})
+}
+
+func withExcluded(method func([]string, ...[]string) func(), excluded ...[]string) func(...string) func() {
+	return func(path ...string) func() {
+		return method(path, excluded...)
+	}
+}
+
+func TestLockTreeExcluding(t *testing.T) {
+	testRun(t, "excluded", func(t *testing.T) {
+		l := new(L)
+		r1 := l.WriteTreeExcluding([]string{"foo"}, []string{"bar"}, []string{"baz", "qux"})
+		r2 := l.WriteNode("foo", "bar")
+		r3 := l.WriteTree("foo", "bar", "quux")
+		r4 := l.ReadNode("foo", "baz", "qux")
+		r4()
+		r3()
+		r2()
+		r1()
+	})
+
+	testRun(t, "not excluded", func(t *testing.T) {
+		l := new(L)
+		r := l.WriteTreeExcluding([]string{"foo"}, []string{"bar"})
+		testLocked(t, l, r, l.ReadNode, "foo", "baz")
+	})
+
+	testRun(t, "node", func(t *testing.T) {
+		l := new(L)
+		r := l.WriteTreeExcluding([]string{"foo"}, []string{"bar"})
+		testLocked(t, l, r, l.ReadNode, "foo")
+	})
+
+	testRun(t, "parent of excluded", func(t *testing.T) {
+		l := new(L)
+		r := l.WriteTreeExcluding([]string{"foo"}, []string{"bar", "baz"})
+		testLocked(t, l, r, l.ReadNode, "foo", "bar")
+	})
+
+	testRun(t, "subtree containing excluded", func(t *testing.T) {
+		l := new(L)
+		r := l.ReadTreeExcluding([]string{"foo"}, []string{"bar", "baz"})
+		testLocked(t, l, r, l.WriteTree, "foo", "bar")
+	})
+
+	testRun(t, "excluded blocked by parent", func(t *testing.T) {
+		l := new(L)
+		r := l.WriteTree("foo")
+		testLocked(t, l, r, withExcluded(l.ReadTreeExcluding, []string{"bar"}), "foo", "baz")
+	})
+
+	testRun(t, "path through excluded", func(t *testing.T) {
+		l := new(L)
+		r1 := l.ReadTreeExcluding([]string{"foo"}, []string{"bar"})
+		r2 := l.IntentWrite("foo", "bar", "baz")
+		r2()
+		r1()
+	})
+	testRun(t, "excluded copied", func(t *testing.T) {
+		l := new(L)
+		excluded := []string{"bar"}
+		r := l.WriteTreeExcluding([]string{"foo"}, excluded)
+		excluded[0] = "baz"
+		l.WriteNode("foo", "bar")()
+		testLocked(t, l, r, l.ReadNode, "foo", "baz")
+	})
+}
+
+func TestLockWildcard(t *testing.T) {
+	testRun(t, "matching", func(t *testing.T) {
+		l := &L{Wildcard: "*"}
+		r := l.WriteNode("users", "*", "settings")
+		testLocked(t, l, r, l.ReadNode, "users", "foo", "settings")
+	})
+
+	testRun(t, "matching wildcard lock", func(t *testing.T) {
+		l := &L{Wildcard: "*"}
+		r := l.WriteNode("users", "foo", "settings")
+		testLocked(t, l, r, l.ReadNode, "users", "*", "settings")
+	})
+
+	testRun(t, "both wildcard", func(t *testing.T) {
+		l := &L{Wildcard: "*"}
+		r := l.WriteNode("users", "*", "settings")
+		testLocked(t, l, r, l.ReadNode, "*", "*", "settings")
+	})
+
+	testRun(t, "not matching", func(t *testing.T) {
+		l := &L{Wildcard: "*"}
+		r1 := l.WriteTree("users", "*", "settings")
+		r2 := l.WriteNode("users", "foo", "profile")
+		r3 := l.WriteNode("users", "foo")
+		r4 := l.WriteNode("groups", "foo", "settings")
+		r4()
+		r3()
+		r2()
+		r1()
+	})
+
+	testRun(t, "parent tree", func(t *testing.T) {
+		l := &L{Wildcard: "*"}
+		r := l.ReadTree("users", "foo")
+		testLocked(t, l, r, l.WriteNode, "users", "*", "settings")
+	})
+
+	testRun(t, "wildcard parent tree", func(t *testing.T) {
+		l := &L{Wildcard: "*"}
+		r := l.ReadTree("users", "*")
+		testLocked(t, l, r, l.WriteNode, "users", "foo", "settings")
+	})
+
+	testRun(t, "subtree", func(t *testing.T) {
+		l := &L{Wildcard: "*"}
+		r := l.WriteNode("users", "foo", "settings", "theme")
+		testLocked(t, l, r, l.ReadTree, "users", "*", "settings")
+	})
+
+	testRun(t, "excluded with wildcard", func(t *testing.T) {
+		l := &L{Wildcard: "*"}
+		r1 := l.WriteTreeExcluding([]string{"users"}, []string{"*", "settings"})
+		r2 := l.WriteNode("users", "foo", "settings")
+		r2()
+		r1()
+	})
+
+	testRun(t, "wildcard not excluded", func(t *testing.T) {
+		l := &L{Wildcard: "*"}
+		r := l.WriteTreeExcluding([]string{"users"}, []string{"foo"})
+		testLocked(t, l, r, l.ReadNode, "users", "*")
+	})
+
+	testRun(t, "disabled", func(t *testing.T) {
+		l := new(L)
+		r1 := l.WriteNode("users", "*", "settings")
+		r2 := l.WriteNode("users", "foo", "settings")
+		r2()
+		r1()
+	})
+}
+
+func withRange(method func(string, string, ...string) func(), from, to string) func(...string) func() {
+	return func(path ...string) func() {
+		return method(from, to, path...)
+	}
+}
+
+func TestLockRange(t *testing.T) {
+	testRun(t, "read ranges", func(t *testing.T) {
+		l := new(L)
+		r1 := l.ReadRange("m", "p", "index")
+		r2 := l.ReadRange("n", "q", "index")
+		r3 := l.ReadNode("index", "n")
+		r4 := l.ReadChildren("index")
+		r5 := l.ReadTree("index")
+		r5()
+		r4()
+		r3()
+		r2()
+		r1()
+	})
+
+	testRun(t, "write in range", func(t *testing.T) {
+		l := new(L)
+		r := l.ReadRange("m", "p", "index")
+		testLocked(t, l, r, l.WriteNode, "index", "n")
+	})
+
+	testRun(t, "write tree in range", func(t *testing.T) {
+		l := new(L)
+		r := l.ReadRange("m", "p", "index")
+		testLocked(t, l, r, l.WriteTree, "index", "p")
+	})
+
+	testRun(t, "write out of range", func(t *testing.T) {
+		l := new(L)
+		r1 := l.WriteRange("m", "p", "index")
+		r2 := l.WriteNode("index", "l")
+		r3 := l.WriteNode("index", "pa")
+		r4 := l.WriteNode("index", "n", "foo")
+		r5 := l.WriteNode("index")
+		r5()
+		r4()
+		r3()
+		r2()
+		r1()
+	})
+
+	testRun(t, "range in write", func(t *testing.T) {
+		l := new(L)
+		r := l.WriteNode("index", "n")
+		testLocked(t, l, r, withRange(l.ReadRange, "m", "p"), "index")
+	})
+
+	testRun(t, "overlapping ranges", func(t *testing.T) {
+		l := new(L)
+		r := l.WriteRange("m", "p", "index")
+		testLocked(t, l, r, withRange(l.ReadRange, "a", "m"), "index")
+	})
+
+	testRun(t, "disjoint ranges", func(t *testing.T) {
+		l := new(L)
+		r1 := l.WriteRange("m", "p", "index")
+		r2 := l.WriteRange("q", "z", "index")
+		r2()
+		r1()
+	})
+
+	testRun(t, "children", func(t *testing.T) {
+		l := new(L)
+		r := l.ReadRange("m", "p", "index")
+		testLocked(t, l, r, l.WriteChildren, "index")
+	})
+
+	testRun(t, "parent tree", func(t *testing.T) {
+		l := new(L)
+		r := l.ReadTree("db")
+		testLocked(t, l, r, withRange(l.WriteRange, "m", "p"), "db", "index")
+	})
+
+	testRun(t, "wildcard", func(t *testing.T) {
+		l := &L{Wildcard: "*"}
+		r := l.ReadRange("m", "p", "index")
+		testLocked(t, l, r, l.WriteNode, "index", "*")
+	})
+
+	testRun(t, "reversed range", func(t *testing.T) {
+		l := new(L)
+		defer func() {
+			if recover() == nil {
+				t.Error("failed to panic")
+			}
+		}()
+
+		l.WriteRange("m", "a", "index")
+	})
+}
+
+func TestLockSemaphore(t *testing.T) {
+	testRun(t, "within limit", func(t *testing.T) {
+		l := new(L)
+		r1 := l.SemaphoreNode(2, "foo")
+		r2 := l.SemaphoreNode(2, "foo")
+		r3 := l.ReadNode("foo")
+		r3()
+		r2()
+		r1()
+	})
+
+	testRun(t, "over limit", func(t *testing.T) {
+		l := new(L)
+		r1 := l.SemaphoreNode(2, "foo")
+		r2 := l.SemaphoreNode(2, "foo")
+		testLocked(t, l, r2, withCount(l.SemaphoreNode, 2), "foo")
+		r1()
+	})
+
+	testRun(t, "slot passed on", func(t *testing.T) {
+		l := new(L)
+		r1 := l.SemaphoreNode(1, "foo")
+		acquired := make(chan func())
+		for i := 0; i < 2; i++ {
+			go func() {
+				acquired <- l.SemaphoreNode(1, "foo")
+			}()
+		}
+
+		time.Sleep(minDelay)
+		select {
+		case <-acquired:
+			t.Fatal("acquired over limit")
+		default:
+		}
+
+		r1()
+		r2 := <-acquired
+		time.Sleep(minDelay)
+		select {
+		case <-acquired:
+			t.Fatal("acquired over limit")
+		default:
+		}
+
+		r2()
+		r3 := <-acquired
+		r3()
+	})
+
+	testRun(t, "write", func(t *testing.T) {
+		l := new(L)
+		r := l.SemaphoreNode(2, "foo")
+		testLocked(t, l, r, l.WriteNode, "foo")
+	})
+
+	testRun(t, "blocked by write", func(t *testing.T) {
+		l := new(L)
+		r := l.WriteNode("foo")
+		testLocked(t, l, r, withCount(l.SemaphoreNode, 2), "foo")
+	})
+
+	testRun(t, "tree", func(t *testing.T) {
+		l := new(L)
+		r := l.SemaphoreTree(4, "foo")
+		testLocked(t, l, r, l.WriteTree, "foo", "bar")
+	})
+
+	testRun(t, "tree blocked by parent", func(t *testing.T) {
+		l := new(L)
+		r := l.WriteTree("foo")
+		testLocked(t, l, r, withCount(l.SemaphoreTree, 4), "foo", "bar")
+	})
+
+	testRun(t, "independent nodes", func(t *testing.T) {
+		l := new(L)
+		r1 := l.SemaphoreNode(1, "foo")
+		r2 := l.SemaphoreNode(1, "bar")
+		r3 := l.SemaphoreTree(1, "foo", "baz")
+		r3()
+		r2()
+		r1()
+	})
+
+	testRun(t, "removed node reset", func(t *testing.T) {
+		l := new(L)
+		r := l.SemaphoreNode(2, "foo", "bar")
+		n := l.findLocked([]string{"foo", "bar"})
+		n.mx.Unlock()
+		r()
+		if n.semaphores != nil {
+			t.Error("semaphore state kept on removed node")
+		}
+	})
+}
+
+func TestLockShards(t *testing.T) {
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+
+	testRun(t, "root blocks every shard", func(t *testing.T) {
+		l := new(L)
+		for _, k := range keys {
+			r := l.WriteTree()
+			testLocked(t, l, r, l.ReadNode, k, "foo")
+		}
+	})
+
+	testRun(t, "shards block root", func(t *testing.T) {
+		l := new(L)
+		var r []func()
+		for _, k := range keys {
+			r = append(r, l.ReadNode(k, "foo"))
+		}
+
+		release := func() {
+			for _, ri := range r {
+				ri()
+			}
+		}
+
+		testLocked(t, l, release, l.WriteTree)
+	})
+
+	testRun(t, "wildcard blocks every shard", func(t *testing.T) {
+		l := &L{Wildcard: "*"}
+		for _, k := range keys {
+			r := l.WriteNode("*", "foo")
+			testLocked(t, l, r, l.ReadNode, k, "foo")
+		}
+	})
+
+	testRun(t, "shards block wildcard", func(t *testing.T) {
+		l := &L{Wildcard: "*"}
+		for _, k := range keys {
+			r := l.WriteNode(k, "foo")
+			testLocked(t, l, r, l.ReadNode, "*", "foo")
+		}
+	})
+
+	testRun(t, "disjoint subtrees under the same top level node", func(t *testing.T) {
+		l := new(L)
+		r := l.ReadNode("data", "a", "foo")
+
+		// the latch of a subtree doesn't block the operations in
+		// the sibling subtrees
+		n := l.findLocked([]string{"data", "a"})
+		l.WriteTree("data", "b")()
+		l.WriteNode("data", "c", "foo")()
+		n.mx.Unlock()
+		r()
+	})
+
+	testRun(t, "independent shards", func(t *testing.T) {
+		l := new(L)
+		var r []func()
+		for _, k := range keys {
+			r = append(r, l.WriteTree(k))
+		}
+
+		if g := l.Grants(); len(g) != len(keys) {
+			t.Error("unexpected grants", g)
+		}
+
+		for _, ri := range r {
+			ri()
+		}
+	})
+}
+
+func TestLockBlockingGraph(t *testing.T) {
+	const n = 120
+	l := new(L)
+	l.init()
+	var ops []*operation
+	for i := 0; i < n; i++ {
+		typ := readLock
+		if i%2 == 1 {
+			typ = writeLock
+		}
+
+		o := &operation{typ: typ, path: []string{"foo"}, depth: unlimitedDepth}
+		l.setShard(o)
+		l.insertOperation(o, false)
+		l.unblock(o, nil)
+		ops = append(ops, o)
+	}
+
+	var edges int
+	for _, o := range ops {
+		edges += len(o.blocking)
+	}
+
+	if edges > 2*n {
+		t.Error("blocking graph too large", edges)
+	}
+
+	for _, o := range ops {
+		if o.waiting != 0 {
+			t.Fatal("released before granted")
+		}
+
+		l.release(o, 0)
+	}
+
+	if g := l.Grants(); len(g) != 0 {
+		t.Error("unexpected grants", g)
+	}
+}
+
+func TestLockAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items randomly with the race detector")
+	}
+
+	l := new(L)
+	l.WriteNode("foo", "bar")()
+	r := l.ReadTree("foo", "baz")
+	defer r()
+
+	// only the returned release function is allocated, when the
+	// methods are called directly
+	for _, f := range []func(){
+		func() { l.ReadNode("foo", "bar")() },
+		func() { l.WriteNode("foo", "bar")() },
+		func() { l.ReadTree("foo", "bar")() },
+		func() { l.WriteTree("foo", "bar")() },
+	} {
+		if a := testing.AllocsPerRun(100, f); a > 1 {
+			t.Error("unexpected allocations", a)
+		}
+	}
+}
+
+func TestLockCanonical(t *testing.T) {
+	testRun(t, "case-insensitive", func(t *testing.T) {
+		l := &L{Canonical: strings.ToLower}
+		r := l.WriteNode("Docs", "README")
+		testLocked(t, l, r, l.ReadNode, "docs", "readme")
+		l.ReadNode("docs", "other")()
+	})
+
+	testRun(t, "tree", func(t *testing.T) {
+		l := &L{Canonical: strings.ToLower}
+		r := l.ReadTree("DOCS")
+		testLocked(t, l, r, l.WriteNode, "Docs", "readme")
+	})
+
+	testRun(t, "wildcard", func(t *testing.T) {
+		l := &L{Wildcard: "X", Canonical: strings.ToLower}
+		r := l.WriteNode("users", "X", "Settings")
+		testLocked(t, l, r, l.ReadNode, "Users", "foo", "settings")
+		l.ReadNode("users", "x")()
+	})
+
+	testRun(t, "excluded", func(t *testing.T) {
+		l := &L{Canonical: strings.ToLower}
+		r := l.WriteTreeExcluding([]string{"Docs"}, []string{"Cache"})
+		l.WriteNode("docs", "cache", "foo")()
+		testLocked(t, l, r, l.ReadNode, "docs", "Readme")
+	})
+
+	testRun(t, "range", func(t *testing.T) {
+		l := &L{Canonical: strings.ToLower}
+		r := l.WriteRange("A", "C", "Docs")
+		testLocked(t, l, r, l.ReadNode, "docs", "b")
+		l.ReadNode("docs", "D")()
+	})
+
+	testRun(t, "grants", func(t *testing.T) {
+		l := &L{Canonical: strings.ToLower}
+		path := []string{"Docs", "README"}
+		r := l.ReadNode(path...)
+		defer r()
+		g := l.Grants("DOCS")
+		if len(g) != 1 || strings.Join(g[0].Path, "/") != "docs/readme" {
+			t.Error("unexpected grants", g)
+		}
+
+		if path[0] != "Docs" {
+			t.Error("path of the caller changed")
+		}
+	})
+}
@@ -0,0 +1,304 @@
+package treelock
+
+import "fmt"
+
+// Scope tells which nodes a custom lock mode applies to, relative to
+// the node represented by the path of the lock.
+type Scope int
+
+const (
+	// ScopeNode applies the lock mode only to the node itself.
+	ScopeNode Scope = iota
+
+	// ScopeSubtree applies the lock mode to the node and all the nodes
+	// in its subtree.
+	ScopeSubtree
+
+	// ScopePath applies the lock mode to the node and all the nodes on
+	// the path to it, including the root. Since the root is on every path,
+	// two path scoped locks in incompatible modes conflict wherever
+	// they are in the tree. Using this scope makes every lock operation
+	// take the latches of the whole tree, like the locks on the root.
+	ScopePath
+
+	// ScopeChildren applies the lock mode only to the set of the
+	// children of the node, but not to the node itself or to the
+	// existing children.
+	ScopeChildren
+)
+
+// Mode defines a custom lock mode. The compatibility of the custom
+// modes is defined by L.Compatible.
+type Mode struct {
+	// Name identifies the mode in the audit log and in the grants.
+	Name string
+
+	// Scope tells which nodes the mode applies to.
+	Scope Scope
+}
+
+// access describes how a lock affects a region of the tree: the locked
+// node itself, the set of its children, the children in a key range,
+// its subtree, or the path to it. For the built-in lock types, the
+// values follow the classical multi-granularity locking modes, extended
+// with the update mode. For custom modes, the access is the index of
+// the mode plus one.
+type access int
+
+const (
+	noAccess access = iota
+	intentRead
+	intentWrite
+	read
+	readIntentWrite
+	update
+	write
+)
+
+type mode struct {
+	name                                string
+	node, children, keys, subtree, path access
+}
+
+// modeSet holds the rules for deciding whether two locks conflict.
+type modeSet struct {
+	modes      []mode
+	compatible [][]bool
+	partial    func(access) access
+	custom     bool
+	hasPath    bool
+	wildcard   string
+}
+
+var builtinModes = modeSet{
+	modes: []mode{
+		readLock:                {"ReadNode", read, noAccess, noAccess, noAccess, noAccess},
+		writeLock:               {"WriteNode", write, noAccess, noAccess, noAccess, noAccess},
+		treeReadLock:            {"ReadTree", read, noAccess, noAccess, read, noAccess},
+		treeWriteLock:           {"WriteTree", write, noAccess, noAccess, write, noAccess},
+		intentReadLock:          {"IntentRead", noAccess, noAccess, noAccess, intentRead, noAccess},
+		intentWriteLock:         {"IntentWrite", noAccess, noAccess, noAccess, intentWrite, noAccess},
+		treeReadIntentWriteLock: {"ReadTreeIntentWrite", read, noAccess, noAccess, readIntentWrite, noAccess},
+		childrenReadLock:        {"ReadChildren", noAccess, read, noAccess, noAccess, noAccess},
+		childrenWriteLock:       {"WriteChildren", noAccess, write, noAccess, noAccess, noAccess},
+		updateLock:              {"UpdateNode", update, noAccess, noAccess, noAccess, noAccess},
+		treeUpdateLock:          {"UpdateTree", update, noAccess, noAccess, update, noAccess},
+		rangeReadLock:           {"ReadRange", noAccess, noAccess, read, noAccess, noAccess},
+		rangeWriteLock:          {"WriteRange", noAccess, noAccess, write, noAccess, noAccess},
+		semaphoreLock:           {"SemaphoreNode", read, noAccess, noAccess, noAccess, noAccess},
+		treeSemaphoreLock:       {"SemaphoreTree", read, noAccess, noAccess, read, noAccess},
+	},
+	compatible: [][]bool{
+		noAccess:        {true, true, true, true, true, true, true},
+		intentRead:      {true, true, true, true, true, true, false},
+		intentWrite:     {true, true, true, false, false, false, false},
+		read:            {true, true, false, true, false, true, false},
+		readIntentWrite: {true, true, false, false, false, false, false},
+		update:          {true, true, false, true, false, false, false},
+		write:           {true, false, false, false, false, false, false},
+	},
+	partial: partialIntention,
+}
+
+// partialIntention returns how the access applies to only a part of the
+// region that it was requested for. Intentions don't affect the parts,
+// because they are expected to be followed by the actual locks on them.
+func partialIntention(a access) access {
+	switch a {
+	case intentRead, intentWrite:
+		return noAccess
+	case readIntentWrite:
+		return read
+	default:
+		return a
+	}
+}
+
+func partialSame(a access) access {
+	return a
+}
+
+func customModes(m []Mode, compatible [][]bool) *modeSet {
+	if len(compatible) != len(m) {
+		panic("treelock: the compatibility matrix does not match the custom modes")
+	}
+
+	s := &modeSet{
+		modes:      make([]mode, len(m)),
+		compatible: make([][]bool, len(m)+1),
+		partial:    partialSame,
+		custom:     true,
+	}
+
+	s.compatible[noAccess] = make([]bool, len(m)+1)
+	for i := range s.compatible[noAccess] {
+		s.compatible[noAccess][i] = true
+	}
+
+	for i, mi := range m {
+		if len(compatible[i]) != len(m) {
+			panic("treelock: the compatibility matrix does not match the custom modes")
+		}
+
+		a := access(i + 1)
+		s.compatible[a] = append([]bool{true}, compatible[i]...)
+		s.modes[i].name = mi.Name
+		s.modes[i].node = a
+		switch mi.Scope {
+		case ScopeNode:
+		case ScopeSubtree:
+			s.modes[i].subtree = a
+		case ScopePath:
+			s.modes[i].path = a
+			s.hasPath = true
+		case ScopeChildren:
+			s.modes[i].node = noAccess
+			s.modes[i].children = a
+		default:
+			panic(fmt.Sprintf("treelock: invalid scope of custom mode: %s", mi.Name))
+		}
+	}
+
+	return s
+}
+
+func (s *modeSet) name(t lockType) string {
+	return s.modes[t].name
+}
+
+func (s *modeSet) compatibleAccess(a, b access) bool {
+	return s.compatible[a][b] && s.compatible[b][a]
+}
+
+// subtreeAccess returns how a lock accesses the nodes in its subtree at
+// the specified distance from the locked node. Beyond the depth of a
+// depth limited lock, there is no access.
+func (s *modeSet) subtreeAccess(o *operation, distance int) access {
+	if o.depth != unlimitedDepth && distance > o.depth {
+		return noAccess
+	}
+
+	return s.modes[o.typ].subtree
+}
+
+// matchSegment tells whether a segment of a lock path matches the
+// segment of the path that it is compared to. A wildcard matches any
+// segment, but when matching against a wildcard, only a wildcard
+// matches, because the compared path covers all the segments.
+func (s *modeSet) matchSegment(segment, to string) bool {
+	return segment == to || s.wildcard != "" && segment == s.wildcard
+}
+
+// excluded tells whether the child lock is in one of the subtrees
+// excluded from the parent lock.
+func (s *modeSet) excluded(parent, child *operation) bool {
+	relative := child.path[len(parent.path):]
+	for _, e := range parent.excluded {
+		if len(e) > len(relative) {
+			continue
+		}
+
+		match := true
+		for i := range e {
+			if !s.matchSegment(e[i], relative[i]) {
+				match = false
+				break
+			}
+		}
+
+		if match {
+			return true
+		}
+	}
+
+	return false
+}
+
+// inRange tells whether a child key is in the key range of a range
+// lock. A wildcard is considered to be in any range.
+func (s *modeSet) inRange(o *operation, key string) bool {
+	return s.wildcard != "" && key == s.wildcard || o.from <= key && key <= o.to
+}
+
+func overlap(a, b *operation) bool {
+	return a.from <= b.to && b.from <= a.to
+}
+
+// conflictOnNode tells whether two locks on the same node prevent each
+// other.
+func (s *modeSet) conflictOnNode(a, b *operation) bool {
+	ma, mb := s.modes[a.typ], s.modes[b.typ]
+	sa, sb := s.subtreeAccess(a, 1), s.subtreeAccess(b, 1)
+	return !s.compatibleAccess(ma.node, mb.node) ||
+		!s.compatibleAccess(ma.children, mb.children) ||
+		overlap(a, b) && !s.compatibleAccess(ma.keys, mb.keys) ||
+		!s.compatibleAccess(ma.keys, mb.children) ||
+		!s.compatibleAccess(ma.children, mb.keys) ||
+		!s.compatibleAccess(ma.keys, s.partial(sb)) ||
+		!s.compatibleAccess(s.partial(sa), mb.keys) ||
+		!s.compatibleAccess(s.partial(sa), mb.children) ||
+		!s.compatibleAccess(ma.children, s.partial(sb)) ||
+		!s.compatibleAccess(sa, sb) ||
+		!s.compatibleAccess(ma.path, mb.path)
+}
+
+// conflictInSubtree tells whether a lock on a node prevents another
+// lock in its subtree, or the other way around.
+func (s *modeSet) conflictInSubtree(parent, child *operation) bool {
+	p, c := s.modes[parent.typ], s.modes[child.typ]
+	distance := len(child.path) - len(parent.path)
+	var pn, pc access
+	if !s.excluded(parent, child) {
+		pn = s.partial(s.subtreeAccess(parent, distance))
+		pc = s.partial(s.subtreeAccess(parent, distance+1))
+	}
+
+	return distance == 1 && s.inRange(parent, child.path[len(parent.path)]) &&
+		!s.compatibleAccess(p.keys, c.node) ||
+		!s.compatibleAccess(pn, c.node) ||
+		!s.compatibleAccess(pc, c.children) ||
+		!s.compatibleAccess(pc, c.keys) ||
+		!s.compatibleAccess(pc, s.subtreeAccess(child, 1)) ||
+		!s.compatibleAccess(p.node, c.path) ||
+		!s.compatibleAccess(p.path, c.path)
+}
+
+// conflict tells whether a lock found in the tree prevents a new lock,
+// or the other way around, depending on how their paths relate. The
+// paths match where their segments are equal, or either of them is a
+// wildcard. When the paths diverge, only their path scoped access can
+// conflict.
+func (s *modeSet) conflict(found, o *operation) bool {
+	fp, op := found.path, o.path
+	for i := 0; i < len(fp) && i < len(op); i++ {
+		if fp[i] != op[i] && (s.wildcard == "" || fp[i] != s.wildcard && op[i] != s.wildcard) {
+			return !s.compatibleAccess(s.modes[found.typ].path, s.modes[o.typ].path)
+		}
+	}
+
+	switch {
+	case len(fp) == len(op):
+		return s.conflictOnNode(found, o)
+	case len(fp) < len(op):
+		return s.conflictInSubtree(found, o)
+	default:
+		return s.conflictInSubtree(o, found)
+	}
+}
+
+// excludesReaders tells whether a lock type may conflict with a read
+// lock on any node.
+func (s *modeSet) excludesReaders(t lockType) bool {
+	m := s.modes[t]
+	return !s.compatibleAccess(m.node, read) ||
+		!s.compatibleAccess(s.partial(m.subtree), read) ||
+		!s.compatibleAccess(m.keys, read)
+}
+
+// checkSubtree tells whether a lock may conflict with the locks in the
+// subtree of its node.
+func (s *modeSet) checkSubtree(o *operation) bool {
+	return s.hasPath ||
+		s.modes[o.typ].keys != noAccess ||
+		s.partial(s.subtreeAccess(o, 1)) != noAccess
+}
@@ -0,0 +1,180 @@
+package treelock
+
+import "testing"
+
+const (
+	customAppend = iota
+	customWrite
+	customWriteTree
+	customCreate
+	customList
+)
+
+func customLock() *L {
+	return &L{
+		Modes: []Mode{
+			{Name: "Append", Scope: ScopeNode},
+			{Name: "Write", Scope: ScopeNode},
+			{Name: "WriteTree", Scope: ScopeSubtree},
+			{Name: "Create", Scope: ScopePath},
+			{Name: "List", Scope: ScopeChildren},
+		},
+		Compatible: [][]bool{
+			{true, false, false, true, true},
+			{false, false, false, true, false},
+			{false, false, false, false, false},
+			{true, true, false, true, true},
+			{true, false, false, true, true},
+		},
+	}
+}
+
+func customMethod(l *L, mode int) func(...string) func() {
+	return func(path ...string) func() {
+		return l.Lock(mode, path...)
+	}
+}
+
+func TestCustomModes(t *testing.T) {
+	testRun(t, "compatible", func(t *testing.T) {
+		l := customLock()
+		r1 := l.Lock(customAppend, "foo")
+		r2 := l.Lock(customAppend, "foo")
+		r2()
+		r1()
+	})
+
+	testRun(t, "incompatible", func(t *testing.T) {
+		l := customLock()
+		r := l.Lock(customAppend, "foo")
+		testLocked(t, l, r, customMethod(l, customWrite), "foo")
+	})
+
+	testRun(t, "node scope", func(t *testing.T) {
+		l := customLock()
+		r1 := l.Lock(customWrite, "foo")
+		r2 := l.Lock(customWrite, "foo", "bar")
+		r2()
+		r1()
+	})
+
+	testRun(t, "subtree scope", func(t *testing.T) {
+		l := customLock()
+		r := l.Lock(customWriteTree, "foo")
+		testLocked(t, l, r, customMethod(l, customAppend), "foo", "bar")
+	})
+
+	testRun(t, "subtree scope on child", func(t *testing.T) {
+		l := customLock()
+		r := l.Lock(customAppend, "foo", "bar")
+		testLocked(t, l, r, customMethod(l, customWriteTree), "foo")
+	})
+
+	testRun(t, "path scope", func(t *testing.T) {
+		l := customLock()
+		r := l.Lock(customWriteTree, "foo", "bar")
+		testLocked(t, l, r, customMethod(l, customCreate), "foo", "bar", "baz")
+	})
+
+	testRun(t, "path scope on parent", func(t *testing.T) {
+		l := customLock()
+		r1 := l.Lock(customCreate, "foo", "bar", "baz")
+		r2 := l.Lock(customWrite, "foo")
+		r2()
+		r1()
+	})
+
+	testRun(t, "path scope on sibling", func(t *testing.T) {
+		l := customLock()
+		r1 := l.Lock(customWriteTree, "foo", "bar")
+		r2 := l.Lock(customCreate, "foo", "baz")
+		r2()
+		r1()
+	})
+
+	testRun(t, "path scope incompatible on parent", func(t *testing.T) {
+		l := customLock()
+		r := l.Lock(customCreate, "foo", "bar", "baz")
+		testLocked(t, l, r, customMethod(l, customWriteTree), "foo")
+	})
+
+	pathLock := func() *L {
+		return &L{
+			Modes:      []Mode{{Name: "P", Scope: ScopePath}, {Name: "Q", Scope: ScopePath}},
+			Compatible: [][]bool{{false, true}, {true, true}},
+		}
+	}
+
+	testRun(t, "path scope incompatible on sibling", func(t *testing.T) {
+		l := pathLock()
+		r := l.Lock(0, "a", "b")
+		testLocked(t, l, r, customMethod(l, 0), "a", "c")
+	})
+
+	testRun(t, "path scope incompatible on cousin", func(t *testing.T) {
+		l := pathLock()
+		r := l.Lock(0, "a", "b", "c")
+		testLocked(t, l, r, customMethod(l, 0), "a", "d", "e")
+	})
+
+	testRun(t, "path scope incompatible on the root", func(t *testing.T) {
+		l := pathLock()
+		r := l.Lock(0, "a")
+		testLocked(t, l, r, customMethod(l, 0), "b")
+	})
+
+	testRun(t, "path scope compatible on sibling", func(t *testing.T) {
+		l := pathLock()
+		r1 := l.Lock(0, "a", "b")
+		r2 := l.Lock(1, "a", "c")
+		r3 := l.Lock(1, "b")
+		r3()
+		r2()
+		r1()
+	})
+
+	testRun(t, "path scope released", func(t *testing.T) {
+		l := pathLock()
+		l.Lock(0, "a", "b")()
+		l.Lock(0, "b")()
+		if !l.tree.operations.empty() {
+			t.Error("path scoped locks not released")
+		}
+	})
+
+	testRun(t, "children scope", func(t *testing.T) {
+		l := customLock()
+		r1 := l.Lock(customList, "foo")
+		r2 := l.Lock(customWrite, "foo")
+		r3 := l.Lock(customWrite, "foo", "bar")
+		r3()
+		r2()
+		r1()
+	})
+
+	testRun(t, "children scope in subtree", func(t *testing.T) {
+		l := customLock()
+		r := l.Lock(customList, "foo", "bar")
+		testLocked(t, l, r, customMethod(l, customWriteTree), "foo")
+	})
+
+	testRun(t, "name in grants", func(t *testing.T) {
+		l := customLock()
+		r := l.Lock(customAppend, "foo")
+		defer r()
+		if g := l.Grants(); len(g) != 1 || g[0].Mode != "Append" {
+			t.Error("unexpected grants", g)
+		}
+	})
+
+	testRun(t, "mixed", func(t *testing.T) {
+		l := customLock()
+		defer func() {
+			if recover() == nil {
+				t.Error("failed to panic")
+			}
+		}()
+
+		l.ReadNode("foo")
+	})
+}
@@ -0,0 +1,284 @@
+//go:build go1.22
+// +build go1.22
+
+package treelock
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+// Of is a variant of L whose paths consist of keys of an arbitrary
+// comparable type, e.g. numeric IDs or structs, instead of strings.
+// Equal keys refer to the same node. The locks behave the same way as
+// the locks of L, except that ranges are not supported, because the
+// keys are not ordered, and neither are wildcards.
+//
+// The keys are mapped to the path segments of the underlying L. The L
+// field can be used to configure the instance, and, together with the
+// Path method, for the features not covered by Of, like owners and
+// grants. The Wildcard and the Canonical fields of L must not be set,
+// because the mapped segments of the keys other than strings and
+// integers are binary encodings, and a canonical form of them could
+// merge distinct keys. The PathSyntax of L is not used by Of. The
+// limits of L apply to the mapped segments.
+//
+// Floating point keys must not be NaN, because NaN is not equal to any
+// key, including itself. The lock methods panic on NaN keys.
+//
+// Of is available only when building with Go 1.22 or newer, because
+// older versions don't allow type parameters in a module declaring an
+// older Go version.
+type Of[K comparable] struct {
+	L L
+}
+
+var (
+	keyTypesMx sync.Mutex
+	keyTypes   = make(map[reflect.Type]uint64)
+)
+
+// Path returns the path of L that the keys are mapped to.
+func (l *Of[K]) Path(keys ...K) []string {
+	p := make([]string, len(keys))
+	for i, k := range keys {
+		p[i] = keySegment(k)
+	}
+
+	return p
+}
+
+func (l *Of[K]) paths(keys [][]K) [][]string {
+	p := make([][]string, len(keys))
+	for i, k := range keys {
+		p[i] = l.Path(k...)
+	}
+
+	return p
+}
+
+// ReadNode acquires a read lock for an individual node, the same way
+// as L.ReadNode.
+func (l *Of[K]) ReadNode(path ...K) func() {
+	return l.L.ReadNode(l.Path(path...)...)
+}
+
+// WriteNode acquires a write lock for an individual node, the same way
+// as L.WriteNode.
+func (l *Of[K]) WriteNode(path ...K) func() {
+	return l.L.WriteNode(l.Path(path...)...)
+}
+
+// ReadTree acquires a read lock for a subtree, the same way as
+// L.ReadTree.
+func (l *Of[K]) ReadTree(path ...K) func() {
+	return l.L.ReadTree(l.Path(path...)...)
+}
+
+// WriteTree acquires a write lock for a subtree, the same way as
+// L.WriteTree.
+func (l *Of[K]) WriteTree(path ...K) func() {
+	return l.L.WriteTree(l.Path(path...)...)
+}
+
+// ReadTreeDepth acquires a read lock for a subtree up to the specified
+// depth, the same way as L.ReadTreeDepth.
+func (l *Of[K]) ReadTreeDepth(depth int, path ...K) func() {
+	return l.L.ReadTreeDepth(depth, l.Path(path...)...)
+}
+
+// WriteTreeDepth acquires a write lock for a subtree up to the
+// specified depth, the same way as L.WriteTreeDepth.
+func (l *Of[K]) WriteTreeDepth(depth int, path ...K) func() {
+	return l.L.WriteTreeDepth(depth, l.Path(path...)...)
+}
+
+// ReadTreeExcluding acquires a read lock for a subtree, excluding the
+// subtrees of the specified descendants, the same way as
+// L.ReadTreeExcluding.
+func (l *Of[K]) ReadTreeExcluding(path []K, excluded ...[]K) func() {
+	return l.L.ReadTreeExcluding(l.Path(path...), l.paths(excluded)...)
+}
+
+// WriteTreeExcluding acquires a write lock for a subtree, excluding
+// the subtrees of the specified descendants, the same way as
+// L.WriteTreeExcluding.
+func (l *Of[K]) WriteTreeExcluding(path []K, excluded ...[]K) func() {
+	return l.L.WriteTreeExcluding(l.Path(path...), l.paths(excluded)...)
+}
+
+// SemaphoreNode acquires a counted lock for an individual node, the
+// same way as L.SemaphoreNode.
+func (l *Of[K]) SemaphoreNode(limit int, path ...K) func() {
+	return l.L.SemaphoreNode(limit, l.Path(path...)...)
+}
+
+// SemaphoreTree acquires a counted lock for a subtree, the same way as
+// L.SemaphoreTree.
+func (l *Of[K]) SemaphoreTree(limit int, path ...K) func() {
+	return l.L.SemaphoreTree(limit, l.Path(path...)...)
+}
+
+// IntentRead acquires an intention read lock, the same way as
+// L.IntentRead.
+func (l *Of[K]) IntentRead(path ...K) func() {
+	return l.L.IntentRead(l.Path(path...)...)
+}
+
+// IntentWrite acquires an intention write lock, the same way as
+// L.IntentWrite.
+func (l *Of[K]) IntentWrite(path ...K) func() {
+	return l.L.IntentWrite(l.Path(path...)...)
+}
+
+// ReadTreeIntentWrite acquires a read tree lock combined with an
+// intention write lock, the same way as L.ReadTreeIntentWrite.
+func (l *Of[K]) ReadTreeIntentWrite(path ...K) func() {
+	return l.L.ReadTreeIntentWrite(l.Path(path...)...)
+}
+
+// ReadChildren acquires a read lock for the set of the children of a
+// node, the same way as L.ReadChildren.
+func (l *Of[K]) ReadChildren(path ...K) func() {
+	return l.L.ReadChildren(l.Path(path...)...)
+}
+
+// WriteChildren acquires a write lock for the set of the children of a
+// node, the same way as L.WriteChildren.
+func (l *Of[K]) WriteChildren(path ...K) func() {
+	return l.L.WriteChildren(l.Path(path...)...)
+}
+
+// UpdateNode acquires an update lock for an individual node, the same
+// way as L.UpdateNode.
+func (l *Of[K]) UpdateNode(path ...K) func() {
+	return l.L.UpdateNode(l.Path(path...)...)
+}
+
+// UpdateTree acquires an update lock for a subtree, the same way as
+// L.UpdateTree.
+func (l *Of[K]) UpdateTree(path ...K) func() {
+	return l.L.UpdateTree(l.Path(path...)...)
+}
+
+// Lock acquires a lock in one of the custom modes, the same way as
+// L.Lock.
+func (l *Of[K]) Lock(mode int, path ...K) func() {
+	return l.L.Lock(mode, l.Path(path...)...)
+}
+
+// keySegment maps a key to a path segment. The mapping is injective
+// for the keys of the same type. Strings are used as they are, and the
+// integers in their decimal form, while the other types are encoded
+// based on their structure.
+func keySegment[K comparable](k K) string {
+	// the static type of the key decides, so that the keys of
+	// interface types holding different types don't collide
+	var zero K
+	switch any(zero).(type) {
+	case string:
+		return any(k).(string)
+	case int:
+		return strconv.Itoa(any(k).(int))
+	case int64:
+		return strconv.FormatInt(any(k).(int64), 10)
+	case int32:
+		return strconv.FormatInt(int64(any(k).(int32)), 10)
+	case uint:
+		return strconv.FormatUint(uint64(any(k).(uint)), 10)
+	case uint64:
+		return strconv.FormatUint(any(k).(uint64), 10)
+	case uint32:
+		return strconv.FormatUint(uint64(any(k).(uint32)), 10)
+	default:
+		return string(appendKey(nil, reflect.ValueOf(&k).Elem()))
+	}
+}
+
+// keyTypeID returns a process wide unique ID of a type, used to encode
+// the dynamic type of the keys held by interfaces.
+func keyTypeID(t reflect.Type) uint64 {
+	keyTypesMx.Lock()
+	defer keyTypesMx.Unlock()
+	id, ok := keyTypes[t]
+	if !ok {
+		id = uint64(len(keyTypes))
+		keyTypes[t] = id
+	}
+
+	return id
+}
+
+func appendUvarint(b []byte, x uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], x)]...)
+}
+
+func appendVarint(b []byte, x int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], x)]...)
+}
+
+func appendFloat(b []byte, f float64) []byte {
+	if math.IsNaN(f) {
+		panic("treelock: NaN key")
+	}
+
+	// -0 equals to 0
+	if f == 0 {
+		f = 0
+	}
+
+	return appendUvarint(b, math.Float64bits(f))
+}
+
+func appendKey(b []byte, v reflect.Value) []byte {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, 1)
+		}
+
+		return append(b, 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendVarint(b, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return appendUvarint(b, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return appendFloat(b, v.Float())
+	case reflect.Complex64, reflect.Complex128:
+		c := v.Complex()
+		return appendFloat(appendFloat(b, real(c)), imag(c))
+	case reflect.String:
+		s := v.String()
+		b = appendUvarint(b, uint64(len(s)))
+		return append(b, s...)
+	case reflect.Ptr, reflect.Chan, reflect.UnsafePointer:
+		return appendUvarint(b, uint64(v.Pointer()))
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			b = appendKey(b, v.Index(i))
+		}
+
+		return b
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			b = appendKey(b, v.Field(i))
+		}
+
+		return b
+	case reflect.Interface:
+		if v.IsNil() {
+			return append(b, 0)
+		}
+
+		e := v.Elem()
+		b = appendUvarint(b, keyTypeID(e.Type())+1)
+		return appendKey(b, e)
+	default:
+		panic("treelock: key not comparable: " + v.Type().String())
+	}
+}
@@ -0,0 +1,92 @@
+//go:build go1.22
+// +build go1.22
+
+package treelock
+
+import (
+	"math"
+	"testing"
+)
+
+type testKey struct {
+	id   int
+	name string
+	tags [2]interface{}
+}
+
+func TestOf(t *testing.T) {
+	t.Run("key segments", func(t *testing.T) {
+		zero := 0.0
+		p1, p2 := new(int), new(int)
+		for _, test := range []struct {
+			name  string
+			k1    interface{}
+			k2    interface{}
+			equal bool
+		}{
+			{"int", 42, 42, true},
+			{"different int", 42, 24, false},
+			{"string", "foo", "foo", true},
+			{"negative zero", zero, -zero, true},
+			{"float", math.Pi, math.E, false},
+			{"pointer", p1, p1, true},
+			{"different pointer", p1, p2, false},
+			{"dynamic type", 1, int64(1), false},
+			{"dynamic type string", 1, "1", false},
+			{"nil", nil, nil, true},
+			{"nil and zero", nil, 0, false},
+			{"struct", testKey{1, "foo", [2]interface{}{1, "bar"}}, testKey{1, "foo", [2]interface{}{1, "bar"}}, true},
+			{"string boundary", testKey{name: "ab"}, testKey{name: "a", tags: [2]interface{}{"b"}}, false},
+			{"struct field", testKey{id: 1}, testKey{id: 2}, false},
+		} {
+			t.Run(test.name, func(t *testing.T) {
+				s1, s2 := keySegment(test.k1), keySegment(test.k2)
+				if (s1 == s2) != test.equal {
+					t.Error("unexpected key segments", s1, s2)
+				}
+			})
+		}
+	})
+
+	testRun(t, "not comparable", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Error("failed to panic")
+			}
+		}()
+
+		keySegment(interface{}([]int{1}))
+	})
+
+	testRun(t, "NaN", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Error("failed to panic")
+			}
+		}()
+
+		new(Of[float64]).ReadNode(math.NaN())
+	})
+
+	testRun(t, "int keys", func(t *testing.T) {
+		l := new(Of[uint64])
+		r := l.WriteNode(1, 2, 3)
+		testLocked(t, &l.L, r, l.L.ReadNode, l.Path(1, 2, 3)...)
+		l.ReadNode(1, 2, 4)()
+		l.ReadNode(1, 2)()
+	})
+
+	testRun(t, "struct keys", func(t *testing.T) {
+		l := new(Of[testKey])
+		r := l.WriteTree(testKey{id: 1, name: "foo"})
+		testLocked(t, &l.L, r, l.L.ReadNode, l.Path(testKey{id: 1, name: "foo"}, testKey{id: 2})...)
+		l.ReadNode(testKey{id: 1, name: "bar"})()
+	})
+
+	testRun(t, "excluding", func(t *testing.T) {
+		l := new(Of[int])
+		r := l.WriteTreeExcluding([]int{1}, []int{2})
+		l.WriteNode(1, 2, 3)()
+		testLocked(t, &l.L, r, l.L.ReadNode, l.Path(1, 3)...)
+	})
+}
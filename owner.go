@@ -0,0 +1,167 @@
+package treelock
+
+import "sync"
+
+// Owner acquires locks from an L instance on behalf of a labeled
+// holder. The label appears in the audit log and in the grants
+// returned by L.Grants.
+//
+// The locks acquired by the same owner don't block each other, similar
+// to the locks of a single transaction in a database. This way an
+// owner can extend or convert its locks, e.g. acquire write locks in a
+// subtree locked by ReadTreeIntentWrite, or a write lock on a node that
+// it already holds a read lock on. When an owner requests a new lock
+// while holding others, it waits only for the conflicting locks that
+// were already granted, and takes precedence over the conflicting
+// operations that are still waiting. It is the responsibility of the
+// caller to not use the same owner for operations that are otherwise
+// expected to exclude each other.
+type Owner struct {
+	l           *L
+	label       string
+	mx          sync.Mutex
+	operations  int
+	escalations map[*node]*escalation
+}
+
+// Owner returns a holder with the provided label, acquiring locks from
+// the current L instance.
+func (l *L) Owner(label string) *Owner {
+	return &Owner{l: l, label: label}
+}
+
+func (o *Owner) count(delta int) {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+	o.operations += delta
+}
+
+func (o *Owner) holding() bool {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+	return o.operations > 0
+}
+
+// ReadNode acquires a read lock for an individual node, the same way
+// as L.ReadNode.
+func (o *Owner) ReadNode(path ...string) func() {
+	return must(o.l.acquire(o, false, readLock, path))
+}
+
+// WriteNode acquires a write lock for an individual node, the same way
+// as L.WriteNode.
+func (o *Owner) WriteNode(path ...string) func() {
+	return must(o.l.acquire(o, false, writeLock, path))
+}
+
+// ReadTree acquires a read lock for a subtree, the same way as
+// L.ReadTree.
+func (o *Owner) ReadTree(path ...string) func() {
+	return must(o.l.acquire(o, false, treeReadLock, path))
+}
+
+// WriteTree acquires a write lock for a subtree, the same way as
+// L.WriteTree.
+func (o *Owner) WriteTree(path ...string) func() {
+	return must(o.l.acquire(o, false, treeWriteLock, path))
+}
+
+// ReadTreeDepth acquires a read lock for a subtree up to the specified
+// depth, the same way as L.ReadTreeDepth.
+func (o *Owner) ReadTreeDepth(depth int, path ...string) func() {
+	return must(o.l.acquireDepth(o, treeReadLock, depth, path))
+}
+
+// WriteTreeDepth acquires a write lock for a subtree up to the
+// specified depth, the same way as L.WriteTreeDepth.
+func (o *Owner) WriteTreeDepth(depth int, path ...string) func() {
+	return must(o.l.acquireDepth(o, treeWriteLock, depth, path))
+}
+
+// ReadTreeExcluding acquires a read lock for a subtree, excluding the
+// subtrees of the specified descendants, the same way as
+// L.ReadTreeExcluding.
+func (o *Owner) ReadTreeExcluding(path []string, excluded ...[]string) func() {
+	return must(o.l.acquireExcluding(o, treeReadLock, path, excluded))
+}
+
+// WriteTreeExcluding acquires a write lock for a subtree, excluding the
+// subtrees of the specified descendants, the same way as
+// L.WriteTreeExcluding.
+func (o *Owner) WriteTreeExcluding(path []string, excluded ...[]string) func() {
+	return must(o.l.acquireExcluding(o, treeWriteLock, path, excluded))
+}
+
+// ReadRange acquires a read lock for a key range of children, the same
+// way as L.ReadRange.
+func (o *Owner) ReadRange(from, to string, path ...string) func() {
+	return must(o.l.acquireRange(o, rangeReadLock, from, to, path))
+}
+
+// WriteRange acquires a write lock for a key range of children, the
+// same way as L.WriteRange.
+func (o *Owner) WriteRange(from, to string, path ...string) func() {
+	return must(o.l.acquireRange(o, rangeWriteLock, from, to, path))
+}
+
+// SemaphoreNode acquires a counted lock for an individual node, the
+// same way as L.SemaphoreNode.
+func (o *Owner) SemaphoreNode(limit int, path ...string) func() {
+	return must(o.l.acquireCounted(o, semaphoreLock, limit, path))
+}
+
+// SemaphoreTree acquires a counted lock for a subtree, the same way as
+// L.SemaphoreTree.
+func (o *Owner) SemaphoreTree(limit int, path ...string) func() {
+	return must(o.l.acquireCounted(o, treeSemaphoreLock, limit, path))
+}
+
+// IntentRead acquires an intention lock for reading the subtree, the
+// same way as L.IntentRead.
+func (o *Owner) IntentRead(path ...string) func() {
+	return must(o.l.acquire(o, false, intentReadLock, path))
+}
+
+// IntentWrite acquires an intention lock for writing in the subtree,
+// the same way as L.IntentWrite.
+func (o *Owner) IntentWrite(path ...string) func() {
+	return must(o.l.acquire(o, false, intentWriteLock, path))
+}
+
+// ReadTreeIntentWrite acquires a read lock for the subtree, combined
+// with the intention to write in it, the same way as
+// L.ReadTreeIntentWrite.
+func (o *Owner) ReadTreeIntentWrite(path ...string) func() {
+	return must(o.l.acquire(o, false, treeReadIntentWriteLock, path))
+}
+
+// ReadChildren acquires a read lock for the set of the children of a
+// node, the same way as L.ReadChildren.
+func (o *Owner) ReadChildren(path ...string) func() {
+	return must(o.l.acquire(o, false, childrenReadLock, path))
+}
+
+// WriteChildren acquires a write lock for the set of the children of a
+// node, the same way as L.WriteChildren.
+func (o *Owner) WriteChildren(path ...string) func() {
+	return must(o.l.acquire(o, false, childrenWriteLock, path))
+}
+
+// UpdateNode acquires an update lock for an individual node, the same
+// way as L.UpdateNode. The lock can be converted to a write lock by
+// calling WriteNode on the same owner.
+func (o *Owner) UpdateNode(path ...string) func() {
+	return must(o.l.acquire(o, false, updateLock, path))
+}
+
+// UpdateTree acquires an update lock for a subtree, the same way as
+// L.UpdateTree. The lock can be converted to write locks in the subtree
+// by calling WriteNode or WriteTree on the same owner.
+func (o *Owner) UpdateTree(path ...string) func() {
+	return must(o.l.acquire(o, false, treeUpdateLock, path))
+}
+
+// Lock acquires a lock in a custom mode, the same way as L.Lock.
+func (o *Owner) Lock(mode int, path ...string) func() {
+	return must(o.l.acquire(o, true, lockType(mode), path))
+}
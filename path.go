@@ -0,0 +1,147 @@
+package treelock
+
+import (
+	"strings"
+	"unicode"
+)
+
+// PathSyntax defines how the string form of a path, e.g. /a/b/c, is
+// converted to the segments of a lock path. The zero value uses "/" as
+// the separator, without case folding or normalization.
+//
+// The conversion cleans the path: empty segments and the segments
+// equal to "." are dropped, while ".." drops the preceding segment. A
+// leading or trailing separator doesn't make a difference, and ".."
+// on the root stays on the root, this way, e.g. "/a//b/", "a/./b" and
+// "/../a/c/../b" all result in the path "a", "b".
+type PathSyntax struct {
+	// Separator is the string separating the segments of the path.
+	// Defaults to "/".
+	Separator string
+
+	// FoldCase, when set, applies Unicode simple case folding to the
+	// segments, making them case-insensitive. The folded segments are
+	// lower case.
+	FoldCase bool
+
+	// Normalize, when set, is applied to the segments, before the case
+	// folding. E.g. to use Unicode NFC normalization, it can be set to
+	// the String method of norm.NFC from golang.org/x/text/unicode/norm.
+	Normalize func(string) string
+}
+
+// foldRune maps the runes that are equal in simple case folding, e.g.
+// 'S', 's' and 'ſ', to the same lower case rune.
+func foldRune(r rune) rune {
+	return unicode.ToLower(unicode.ToUpper(r))
+}
+
+// Parse converts the string form of a path to the segments of a lock
+// path.
+func (s PathSyntax) Parse(p string) []string {
+	path, _ := s.parse(p, 0, 0)
+	return path
+}
+
+// parse converts the string form of a path, while enforcing the limits
+// of the depth and the segment length, when they are set. The limits
+// are checked segment by segment, before the rest of the input is
+// processed, so that an oversized input is rejected without splitting
+// it as a whole. The depth limit applies also to the segments that are
+// dropped by a subsequent "..".
+func (s PathSyntax) parse(p string, maxDepth, maxSegmentLength int) ([]string, error) {
+	sep := s.Separator
+	if sep == "" {
+		sep = "/"
+	}
+
+	var path []string
+	for done := false; !done; {
+		segment := p
+		if i := strings.Index(p, sep); i >= 0 {
+			segment, p = p[:i], p[i+len(sep):]
+		} else {
+			done = true
+		}
+
+		switch segment {
+		case "", ".":
+		case "..":
+			if len(path) > 0 {
+				path = path[:len(path)-1]
+			}
+		default:
+			if maxSegmentLength > 0 && len(segment) > maxSegmentLength {
+				return nil, ErrSegmentTooLong
+			}
+
+			if maxDepth > 0 && len(path) == maxDepth {
+				return nil, ErrPathTooDeep
+			}
+
+			if s.Normalize != nil {
+				segment = s.Normalize(segment)
+			}
+
+			if s.FoldCase {
+				segment = strings.Map(foldRune, segment)
+			}
+
+			path = append(path, segment)
+		}
+	}
+
+	return path, nil
+}
+
+// Format returns the string form of a lock path, starting with the
+// separator.
+func (s PathSyntax) Format(path []string) string {
+	sep := s.Separator
+	if sep == "" {
+		sep = "/"
+	}
+
+	return sep + strings.Join(path, sep)
+}
+
+// ParsePath converts the string form of a path to the segments of a
+// lock path, using the PathSyntax of L.
+func (l *L) ParsePath(p string) []string {
+	return l.PathSyntax.Parse(p)
+}
+
+func (l *L) acquirePath(owner *Owner, typ lockType, p string) (func(), error) {
+	path, err := l.PathSyntax.parse(p, l.MaxPathDepth, l.MaxSegmentLength)
+	if err != nil {
+		return nil, err
+	}
+
+	return l.acquire(owner, false, typ, path)
+}
+
+// ReadNodePath acquires a read lock for the node represented by the
+// string form of its path, the same way as ReadNode.
+func (l *L) ReadNodePath(p string) func() {
+	return must(l.acquirePath(nil, readLock, p))
+}
+
+// WriteNodePath acquires a write lock for the node represented by the
+// string form of its path, the same way as WriteNode.
+func (l *L) WriteNodePath(p string) func() {
+	return must(l.acquirePath(nil, writeLock, p))
+}
+
+// ReadTreePath acquires a read lock for the subtree starting from the
+// node represented by the string form of its path, the same way as
+// ReadTree.
+func (l *L) ReadTreePath(p string) func() {
+	return must(l.acquirePath(nil, treeReadLock, p))
+}
+
+// WriteTreePath acquires a write lock for the subtree starting from
+// the node represented by the string form of its path, the same way as
+// WriteTree.
+func (l *L) WriteTreePath(p string) func() {
+	return must(l.acquirePath(nil, treeWriteLock, p))
+}
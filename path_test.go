@@ -0,0 +1,71 @@
+package treelock
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPathSyntax(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		syntax PathSyntax
+		path   string
+		expect []string
+	}{
+		{"empty", PathSyntax{}, "", nil},
+		{"root", PathSyntax{}, "/", nil},
+		{"simple", PathSyntax{}, "/a/b/c", []string{"a", "b", "c"}},
+		{"relative", PathSyntax{}, "a/b", []string{"a", "b"}},
+		{"duplicate separators", PathSyntax{}, "/a//b", []string{"a", "b"}},
+		{"trailing separator", PathSyntax{}, "/a/b/", []string{"a", "b"}},
+		{"dot", PathSyntax{}, "/a/./b/.", []string{"a", "b"}},
+		{"dot dot", PathSyntax{}, "/a/c/../b", []string{"a", "b"}},
+		{"dot dot on root", PathSyntax{}, "/../../a", []string{"a"}},
+		{"dot dot to root", PathSyntax{}, "/a/..", nil},
+		{"custom separator", PathSyntax{Separator: "::"}, "a::b::::c", []string{"a", "b", "c"}},
+		{"fold case", PathSyntax{FoldCase: true}, "/Docs/ſTRASSE/ΣΑΣ", []string{"docs", "strasse", "σασ"}},
+		{"case sensitive", PathSyntax{}, "/Docs", []string{"Docs"}},
+		{"normalize", PathSyntax{Normalize: strings.TrimSpace}, "/ a /b ", []string{"a", "b"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p := test.syntax.Parse(test.path)
+			if (len(p) > 0 || len(test.expect) > 0) && !reflect.DeepEqual(p, test.expect) {
+				t.Error("unexpected path", p)
+			}
+		})
+	}
+
+	t.Run("format", func(t *testing.T) {
+		if p := (PathSyntax{}).Format([]string{"a", "b"}); p != "/a/b" {
+			t.Error("unexpected path", p)
+		}
+
+		if p := (PathSyntax{Separator: "."}).Format(nil); p != "." {
+			t.Error("unexpected path", p)
+		}
+	})
+}
+
+func TestLockPath(t *testing.T) {
+	testRun(t, "node", func(t *testing.T) {
+		l := new(L)
+		r := l.WriteNodePath("/a//b/")
+		testLocked(t, l, r, l.ReadNode, "a", "b")
+	})
+
+	testRun(t, "tree", func(t *testing.T) {
+		l := &L{PathSyntax: PathSyntax{FoldCase: true}}
+		r := l.ReadTreePath("/Docs")
+		testLocked(t, l, r, l.WriteNode, "docs", "readme")
+		l.WriteNodePath("/Other")()
+	})
+
+	testRun(t, "string form", func(t *testing.T) {
+		l := new(L)
+		r := l.WriteTreePath("a/b")
+		testLocked(t, l, r, func(path ...string) func() {
+			return l.ReadNodePath(strings.Join(path, "/"))
+		}, "a", "..", "a", "b", ".", "c")
+	})
+}
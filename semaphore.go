@@ -0,0 +1,84 @@
+package treelock
+
+import "strconv"
+
+// semaphore counts the slots taken by the counted locks on a node, and
+// holds the counted locks waiting for a free slot, in the order of
+// their request.
+type semaphore struct {
+	slots int
+	queue []*operation
+}
+
+// semaphoreKey identifies the semaphore of a counted lock on the node
+// where it is anchored. It is empty, unless the path of the lock
+// contains wildcards, in which case the semaphore belongs to the rest
+// of the path after the anchor node.
+func semaphoreKey(o *operation) string {
+	rest := o.path[len(o.items)-1:]
+	if len(rest) == 0 {
+		return ""
+	}
+
+	var b []byte
+	for _, s := range rest {
+		b = strconv.AppendInt(b, int64(len(s)), 10)
+		b = append(b, ':')
+		b = append(b, s...)
+	}
+
+	return string(b)
+}
+
+// takeSlot makes a counted lock take a free slot on its node, or, when
+// there is none, wait until one becomes available. It expects the latch
+// of the node.
+func takeSlot(n *node, o *operation) {
+	key := semaphoreKey(o)
+	s := n.semaphores[key]
+	if s == nil {
+		if n.semaphores == nil {
+			n.semaphores = make(map[string]*semaphore)
+		}
+
+		s = &semaphore{}
+		n.semaphores[key] = s
+	}
+
+	if len(s.queue) == 0 && s.slots < o.limit {
+		s.slots++
+		return
+	}
+
+	s.queue = append(s.queue, o)
+	o.mx.Lock()
+	o.waiting++
+	o.mx.Unlock()
+	o.blockedBy.Add(1)
+}
+
+// releaseSlot frees the slot of a released counted lock, and passes it
+// on to the next waiting counted lock, if the number of taken slots
+// allows it. It expects the latch of the node.
+func (l *L) releaseSlot(n *node, o *operation) {
+	key := semaphoreKey(o)
+	s := n.semaphores[key]
+	s.slots--
+	if len(s.queue) == 0 {
+		if s.slots == 0 {
+			delete(n.semaphores, key)
+		}
+
+		return
+	}
+
+	if s.slots >= s.queue[0].limit {
+		return
+	}
+
+	next := s.queue[0]
+	s.queue[0] = nil
+	s.queue = s.queue[1:]
+	s.slots++
+	l.unblock(next, nil)
+}
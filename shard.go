@@ -0,0 +1,121 @@
+package treelock
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// shardCount is the number of the shards that the top level subtrees
+// are distributed across.
+const shardCount = 64
+
+// shard holds the top level subtrees whose first path segment is
+// hashed to it. The root node of a shard is only a placeholder for the
+// top level nodes, and it never holds operations, but every operation
+// of the shard is registered in its subtree operations. Its latch is
+// the first one taken by the operations of the shard. Besides the
+// subtrees, a shard holds the interned path segments hashed to it, by
+// the hash of the segment itself, and not by the shard of the path.
+//
+// The operations on the root node, and on the paths starting with a
+// wildcard, are global. They are stored in the root node of L, and they
+// take the latch of every shard, so the operations of the shards need
+// to check the global operations only when there are any. When custom
+// modes with ScopePath are used, every operation is global, because
+// the path scoped locks apply to the root node, too.
+type shard struct {
+	shardState
+
+	// padding to a multiple of the cache line size, to avoid false
+	// sharing between the latches of the neighboring shards
+	_ [cacheLine - unsafe.Sizeof(shardState{})%cacheLine]byte
+}
+
+type shardState struct {
+	root      node
+	stringsMx sync.Mutex
+	strings   interner
+}
+
+func shardIndex(segment string) int {
+	// FNV-1a
+	h := uint32(2166136261)
+	for i := 0; i < len(segment); i++ {
+		h ^= uint32(segment[i])
+		h *= 16777619
+	}
+
+	return int(h % shardCount)
+}
+
+func (l *L) global(path []string) bool {
+	return l.modes != nil && l.modes.hasPath ||
+		len(path) == 0 ||
+		l.Wildcard != "" && path[0] == l.Wildcard
+}
+
+// anchor returns the depth of the node where the operations with the
+// path are stored: the longest prefix of the path without wildcards,
+// or the root node of L for the global operations.
+func (l *L) anchor(path []string) int {
+	if l.global(path) {
+		return 0
+	}
+
+	if l.Wildcard != "" {
+		for i, s := range path {
+			if s == l.Wildcard {
+				return i
+			}
+		}
+	}
+
+	return len(path)
+}
+
+func (l *L) setShard(o *operation) {
+	o.global = l.global(o.path)
+	if !o.global {
+		o.shard = &l.shards[shardIndex(o.path[0])]
+	}
+}
+
+// releaseStrings releases the interned segments of the removed nodes.
+// It takes the mutex of a shard only once for the consecutive segments
+// hashed to the same shard.
+func (l *L) releaseStrings(segments []string) {
+	var sh *shard
+	for _, s := range segments {
+		if next := &l.shards[shardIndex(s)]; next != sh {
+			if sh != nil {
+				sh.stringsMx.Unlock()
+			}
+
+			sh = next
+			sh.stringsMx.Lock()
+		}
+
+		sh.strings.release(s)
+	}
+
+	if sh != nil {
+		sh.stringsMx.Unlock()
+	}
+}
+
+// lockShards takes the latches of every shard, and the latch of the
+// root node of L, for a global operation.
+func (l *L) lockShards() {
+	for i := range l.shards {
+		l.shards[i].root.mx.Lock()
+	}
+
+	l.tree.mx.Lock()
+}
+
+func (l *L) unlockShards() {
+	l.tree.mx.Unlock()
+	for i := range l.shards {
+		l.shards[i].root.mx.Unlock()
+	}
+}
@@ -1,51 +1,117 @@
 package treelock
 
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// node holds the operations anchored to it, and the operations
+// anchored in its subtree. The fields of a node are protected by its
+// latch, mx. The latches are taken from the top to the bottom, hand
+// over hand: the latch of a child is taken before releasing the latch
+// of the parent.
 type node struct {
-	operations        listRange
-	subtreeOperations listRange
-	children          map[string]*node
+	mx                sync.Mutex
+	operations        list
+	subtreeOperations list
+	children          children
+	semaphores        map[string]*semaphore
 }
 
-func nodePath(from *node, path []string) []*node {
-	np := make([]*node, 1, len(path)+1)
-	np[0] = from
+// nodePool holds the nodes removed from the tree, together with the
+// storage of their children, to be reused.
+var nodePool = sync.Pool{New: func() interface{} { return &node{} }}
+
+// findLocked returns the node of a path with its latch taken, or nil
+// if the node doesn't exist. The path must belong to a shard.
+func (l *L) findLocked(path []string) *node {
+	n := &l.shards[shardIndex(path[0])].root
+	n.mx.Lock()
 	for _, p := range path {
-		n, ok := np[len(np)-1].children[p]
-		if !ok {
-			if np[len(np)-1].children == nil {
-				np[len(np)-1].children = make(map[string]*node)
-			}
+		c := n.children.get(p)
+		if c != nil {
+			c.mx.Lock()
+		}
 
-			n = &node{}
-			np[len(np)-1].children[p] = n
+		n.mx.Unlock()
+		if c == nil {
+			return nil
 		}
 
-		np = append(np, n)
+		n = c
 	}
 
-	return np
+	return n
 }
 
-func insert(nodePath []*node, o *operation) {
-	o.item = &item{operation: o}
-	n, nodePath := nodePath[len(nodePath)-1], nodePath[:len(nodePath)-1]
-	n.operations = insertTo(n.operations, o.item)
-	connect(n.operations, n.subtreeOperations)
-	for j := len(nodePath) - 1; j >= 0; j-- {
-		n = nodePath[j]
-		n.subtreeOperations = insertTo(n.subtreeOperations, o.item)
-		connect(n.operations, n.subtreeOperations)
+// removeItem removes the item of an operation from a node on its path.
+// The last item is in the operations of the node where the operation
+// is anchored, the rest are in the subtree operations of the nodes
+// above it. It expects the latch of the node.
+func (l *L) removeItem(n *node, o *operation, i int) {
+	if i < len(o.items)-1 {
+		n.subtreeOperations.remove(&o.items[i])
+		return
+	}
+
+	n.operations.remove(&o.items[i])
+	if o.limit > 0 {
+		l.releaseSlot(n, o)
 	}
 }
 
-func remove(nodePath []*node, o *operation) {
-	n := nodePath[len(nodePath)-1]
-	n.operations = removeFrom(n.operations, o.item)
-	for j := len(nodePath) - 1; j >= 0; j-- {
-		n = nodePath[j]
-		n.subtreeOperations = removeFrom(n.subtreeOperations, o.item)
-		if j > 0 && n.operations.empty() && n.subtreeOperations.empty() {
-			delete(nodePath[j-1].children, o.path[j-1])
+// removeOperation removes the operation from the nodes where it was
+// registered, taking their latches hand over hand, the same way as the
+// operation was inserted. The nodes left without operations are
+// removed from the tree, and put back to the pool. Since the node of an
+// operation is removed only when no other operations are registered on
+// it, and the latch of the parent is held while removing it, the
+// removed nodes can't be reached by other operations anymore. The
+// removed nodes are always at the end of the path, because every
+// operation registered below a node is registered on the node, too.
+func (l *L) removeOperation(o *operation) {
+	np := o.nodes
+	if len(np) == 0 {
+		return
+	}
+
+	if o.global {
+		np[0].mx.Lock()
+		l.removeItem(np[0], o, 0)
+		np[0].mx.Unlock()
+		atomic.AddInt32(&l.globals, -1)
+		return
+	}
+
+	np[0].mx.Lock()
+	l.removeItem(np[0], o, 0)
+	removedFrom := len(np)
+	for i := 1; i < len(np); i++ {
+		parent, n := np[i-1], np[i]
+		n.mx.Lock()
+		l.removeItem(n, o, i)
+		if n.operations.empty() && n.subtreeOperations.empty() {
+			parent.children.remove(o.path[i-1])
+			if removedFrom == len(np) {
+				removedFrom = i
+			}
+		}
+
+		parent.mx.Unlock()
+		if i-1 >= removedFrom {
+			putNode(parent)
 		}
 	}
+
+	last := np[len(np)-1]
+	last.mx.Unlock()
+	if removedFrom < len(np) {
+		putNode(last)
+		l.releaseStrings(o.path[removedFrom-1 : len(np)-1])
+	}
+}
+
+func putNode(n *node) {
+	n.semaphores = nil
+	nodePool.Put(n)
 }